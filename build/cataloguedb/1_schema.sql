@@ -13,7 +13,70 @@ CREATE TABLE films (
   title VARCHAR(250) NOT NULL,
   year INT,
   last_update TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-  PRIMARY KEY  (id)
+  sync_origin VARCHAR(20),
+  sync_hash VARCHAR(64),
+  PRIMARY KEY  (id),
+  UNIQUE KEY idx_films_external_id (external_id),
+  UNIQUE KEY idx_films_uuid (uuid),
+  KEY idx_films_title (title, id),
+  KEY idx_films_year (year, id),
+  KEY idx_films_last_update (last_update, id)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE outbox (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  aggregate_id VARCHAR(50) NOT NULL,
+  payload BLOB,
+  request_id VARCHAR(64),
+  trace_context VARCHAR(1024),
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  sent_at TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY  (id),
+  KEY idx_outbox_sent_at (sent_at, id)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE conflicts (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  film_uuid VARCHAR(50),
+  external_id BIGINT,
+  detected_by VARCHAR(20) NOT NULL,
+  strategy VARCHAR(30) NOT NULL,
+  local_origin VARCHAR(20) NOT NULL,
+  local_title VARCHAR(250) NOT NULL,
+  local_year INT NOT NULL,
+  local_last_update TIMESTAMP NOT NULL,
+  incoming_origin VARCHAR(20) NOT NULL,
+  incoming_title VARCHAR(250) NOT NULL,
+  incoming_year INT NOT NULL,
+  incoming_last_update TIMESTAMP NOT NULL,
+  status VARCHAR(20) NOT NULL,
+  resolution VARCHAR(20),
+  detected_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  resolved_at TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY  (id),
+  KEY idx_conflicts_status (status)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE film_identities (
+  uuid VARCHAR(50) NOT NULL,
+  legacy_film_id BIGINT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY  (uuid),
+  UNIQUE KEY idx_film_identities_legacy_film_id (legacy_film_id)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE processed_events (
+  event_id VARCHAR(100) NOT NULL,
+  processed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY  (event_id),
+  KEY idx_processed_events_processed_at (processed_at)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE backfill_checkpoints (
+  name VARCHAR(50) NOT NULL,
+  last_film_id BIGINT NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY  (name)
 )ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
 DELIMITER ;
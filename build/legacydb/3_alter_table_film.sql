@@ -1 +1,4 @@
 ALTER TABLE film ADD COLUMN uuid VARCHAR(50);
+ALTER TABLE film ADD COLUMN deleted_at TIMESTAMP NULL DEFAULT NULL;
+ALTER TABLE film ADD COLUMN sync_origin VARCHAR(20);
+ALTER TABLE film ADD COLUMN sync_hash VARCHAR(64);
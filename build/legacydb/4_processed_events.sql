@@ -0,0 +1,6 @@
+CREATE TABLE processed_events (
+  event_id VARCHAR(100) NOT NULL,
+  processed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY  (event_id),
+  KEY idx_processed_events_processed_at (processed_at)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,10 @@
+CREATE TABLE film_identities (
+  uuid VARCHAR(50) NOT NULL,
+  legacy_film_id SMALLINT UNSIGNED NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY  (uuid),
+  UNIQUE KEY idx_film_identities_legacy_film_id (legacy_film_id)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+INSERT INTO film_identities (uuid, legacy_film_id)
+SELECT uuid, film_id FROM film WHERE uuid IS NOT NULL AND uuid <> '';
@@ -0,0 +1,10 @@
+CREATE TABLE binlog_positions (
+  name VARCHAR(50) NOT NULL,
+  file VARCHAR(255) NOT NULL,
+  position INT UNSIGNED NOT NULL,
+  gtid_set TEXT DEFAULT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY  (name)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+GRANT REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO 'admin'@'%';
@@ -0,0 +1,7 @@
+CREATE TABLE poller_watermarks (
+  name VARCHAR(50) NOT NULL,
+  last_update TIMESTAMP NOT NULL,
+  film_id SMALLINT UNSIGNED NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY  (name)
+)ENGINE=InnoDB DEFAULT CHARSET=utf8;
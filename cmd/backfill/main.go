@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/identity"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/origin"
+	"github.com/google/uuid"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage: backfill [flags]
+
+Seeds the catalogue DB (db.dsn) with the films of the legacy DB (legacy.dsn), in chunks of films ordered by their ID.
+The progress is checkpointed after every chunk, so an interrupted backfill resumes after the last written chunk.
+
+Flags:
+`
+
+const checkpointName = "films"
+
+const getLegacyFilmsSQL = "select film_id, uuid, title, release_year, last_update from film where film_id > ? and deleted_at is null order by film_id limit ?"
+const getCatalogueFilmUUIDsSQL = "select external_id, uuid from films where external_id in (%s) and uuid is not null"
+const assignFilmUUIDSQL = "update film set uuid = ?, last_update = last_update where film_id = ?"
+const getCheckpointSQL = "select last_film_id from backfill_checkpoints where name = ?"
+const saveCheckpointSQL = "insert into backfill_checkpoints (name, last_film_id) values (?, ?) on duplicate key update last_film_id = values(last_film_id)"
+
+// upsertFilmsSQL inserts the films, or updates the ones already in the catalogue, unless they were changed after the
+// legacy film. Films linked before they had a UUID get the one of the legacy film. The last update is assigned last,
+// since the conditions read the value being replaced.
+const upsertFilmsSQL = "insert into films (external_id, uuid, title, year, last_update, sync_origin, sync_hash) values %s on duplicate key update " +
+	"external_id = values(external_id), " +
+	"uuid = coalesce(uuid, values(uuid)), " +
+	"title = if(values(last_update) > last_update, values(title), title), " +
+	"year = if(values(last_update) > last_update, values(year), year), " +
+	"sync_origin = if(values(last_update) > last_update, values(sync_origin), sync_origin), " +
+	"sync_hash = if(values(last_update) > last_update, values(sync_hash), sync_hash), " +
+	"last_update = greatest(last_update, values(last_update))"
+
+var configPath = flag.String("config", "", "Config file path")
+var chunkSize = flag.Int("chunk-size", 100, "Number of films read and written at once")
+var pause = flag.Duration("pause", 0, "Pause between chunks")
+var businessHours = flag.String("business-hours", "", "Local hours, as 09:00-18:00, during which -business-pause is used instead of -pause")
+var businessPause = flag.Duration("business-pause", 5*time.Second, "Pause between chunks during the business hours")
+var restart = flag.Bool("restart", false, "Ignore the checkpoint and start over from the first film")
+
+var catalogueConn database.Connection
+var legacyConn database.Connection
+var logger *slog.Logger
+
+// legacyFilm is a film read from the legacy DB. StoredUUID is the UUID of the legacy row, which differs from UUID
+// until the UUID of the film is written back.
+type legacyFilm struct {
+	ID         int
+	UUID       string
+	StoredUUID sql.NullString
+	Title      string
+	Year       sql.NullInt64
+	LastUpdate time.Time
+}
+
+// throttle pauses the backfill between chunks, for longer during the business hours, so the legacy DB is not loaded
+// while it is busiest.
+type throttle struct {
+	pause         time.Duration
+	businessPause time.Duration
+	// from and to are the minutes of the day the business hours start and end at, if any.
+	from, to int
+}
+
+func loadConfigurations() configs.Configurer {
+	config, err := configs.Load(*configPath, configs.WithoutKafka(), configs.WithLegacyDB())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+func createLogger(config configs.AppConfigurer) *slog.Logger {
+	logger, err := logging.New(config.LogLevel())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return logger
+}
+
+func createDBConnection(config configs.DBConfigurer) database.Connection {
+	conn, err := database.NewConnection(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn
+}
+
+// parseThrottle reads the throttle of the backfill from its flags.
+func parseThrottle() (throttle, error) {
+	t := throttle{pause: *pause, businessPause: *businessPause, from: -1, to: -1}
+	if *businessHours == "" {
+		return t, nil
+	}
+	from, to, ok := strings.Cut(*businessHours, "-")
+	if !ok {
+		return throttle{}, fmt.Errorf("invalid business hours %q: a range such as 09:00-18:00 was expected", *businessHours)
+	}
+	var err error
+	if t.from, err = parseClock(from); err != nil {
+		return throttle{}, err
+	}
+	if t.to, err = parseClock(to); err != nil {
+		return throttle{}, err
+	}
+	return t, nil
+}
+
+// parseClock returns the minute of the day of the given HH:MM time.
+func parseClock(value string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid business hour %q: %w", value, err)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// duration returns the pause that follows a chunk written at the given time. Business hours ending before they start
+// span midnight.
+func (t throttle) duration(now time.Time) time.Duration {
+	if t.from < 0 {
+		return t.pause
+	}
+	minute := now.Hour()*60 + now.Minute()
+	business := minute >= t.from && minute < t.to
+	if t.from > t.to {
+		business = minute >= t.from || minute < t.to
+	}
+	if business {
+		return t.businessPause
+	}
+	return t.pause
+}
+
+// wait pauses after a chunk, returning early when the given context is done.
+func (t throttle) wait(ctx context.Context) error {
+	d := t.duration(time.Now())
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// loadCheckpoint returns the ID of the last film written by a previous run, or 0 when there is none.
+func loadCheckpoint(ctx context.Context) (int, error) {
+	ctx, cancel := catalogueConn.CreateContext(ctx)
+	defer cancel()
+	var lastID int
+	err := catalogueConn.DB().QueryRowContext(ctx, getCheckpointSQL, checkpointName).Scan(&lastID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("an error occured while loading the checkpoint: %w", err)
+	}
+	return lastID, nil
+}
+
+// readChunk reads the legacy films that follow the given film ID, skipping the ones flagged as deleted.
+func readChunk(ctx context.Context, afterID int, size int) ([]*legacyFilm, error) {
+	ctx, cancel := legacyConn.CreateContext(ctx)
+	defer cancel()
+	rows, err := legacyConn.DB().QueryContext(ctx, getLegacyFilmsSQL, afterID, size)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while reading the legacy films: %w", err)
+	}
+	defer rows.Close()
+	var films []*legacyFilm
+	for rows.Next() {
+		film := &legacyFilm{}
+		if err = rows.Scan(&film.ID, &film.StoredUUID, &film.Title, &film.Year, &film.LastUpdate); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the legacy films: %w", err)
+		}
+		films = append(films, film)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("an error occured while reading the legacy films: %w", err)
+	}
+	return films, nil
+}
+
+// identify sets the UUID of each film of the chunk, reusing the one it is mapped to in either database, the one of the
+// catalogue film already linked to it, or the one of its legacy row, and assigning a new one otherwise. The mappings
+// are recorded in the legacy DB, where new UUIDs are written back to the film rows, before the chunk is written to the
+// catalogue, so a chunk retried after an interruption gets the same UUIDs. A catalogue film linked to the legacy film
+// under another UUID than the mapped one fails the backfill, since it would be duplicated by the next sync.
+func identify(ctx context.Context, films []*legacyFilm) error {
+	ids := make([]int, 0, len(films))
+	for _, film := range films {
+		ids = append(ids, film.ID)
+	}
+	catalogueCtx, cancel := catalogueConn.CreateContext(ctx)
+	defer cancel()
+	var catalogueMappings map[int]identity.Mapping
+	var linked map[int]string
+	err := catalogueConn.Transaction(catalogueCtx, func(tx *sql.Tx) error {
+		var err error
+		if catalogueMappings, err = identity.ByLegacyIDs(catalogueCtx, tx, ids); err != nil {
+			return err
+		}
+		linked, err = linkedFilms(catalogueCtx, tx, ids)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	legacyCtx, cancel := legacyConn.CreateContext(ctx)
+	defer cancel()
+	return legacyConn.Transaction(legacyCtx, func(tx *sql.Tx) error {
+		legacyMappings, err := identity.ByLegacyIDs(legacyCtx, tx, ids)
+		if err != nil {
+			return err
+		}
+		for _, film := range films {
+			linkedUUID, isLinked := linked[film.ID]
+			if m, ok := catalogueMappings[film.ID]; ok {
+				film.UUID = m.UUID
+			} else if m, ok := legacyMappings[film.ID]; ok {
+				film.UUID = m.UUID
+			} else if isLinked {
+				film.UUID = linkedUUID
+			} else if film.StoredUUID.String != "" {
+				film.UUID = film.StoredUUID.String
+			} else {
+				film.UUID = uuid.New().String()
+			}
+			if isLinked && linkedUUID != film.UUID {
+				return fmt.Errorf("the legacy film %d is mapped to the UUID %s, but its catalogue film has the UUID %s", film.ID, film.UUID, linkedUUID)
+			}
+			if err = identity.Map(legacyCtx, tx, identity.Mapping{UUID: film.UUID, LegacyID: film.ID}); err != nil {
+				return err
+			}
+			if film.StoredUUID.String == film.UUID {
+				continue
+			}
+			if _, err = tx.ExecContext(legacyCtx, assignFilmUUIDSQL, film.UUID, film.ID); err != nil {
+				return fmt.Errorf("an error occured while assigning the UUID %s: %w", film.UUID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// linkedFilms returns the UUIDs of the catalogue films already linked to the given legacy films, by their external ID.
+func linkedFilms(ctx context.Context, tx *sql.Tx, ids []int) (map[int]string, error) {
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	query := fmt.Sprintf(getCatalogueFilmUUIDsSQL, strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", "))
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while searching the catalogue films: %w", err)
+	}
+	defer rows.Close()
+	linked := make(map[int]string, len(ids))
+	for rows.Next() {
+		var id int
+		var filmUUID string
+		if err = rows.Scan(&id, &filmUUID); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the catalogue films: %w", err)
+		}
+		linked[id] = filmUUID
+	}
+	return linked, rows.Err()
+}
+
+// writeChunk upserts the given identified films into the catalogue along with their mappings, saving the checkpoint
+// in the same transaction.
+func writeChunk(ctx context.Context, films []*legacyFilm) error {
+	ctx, cancel := catalogueConn.CreateContext(ctx)
+	defer cancel()
+	return catalogueConn.Transaction(ctx, func(tx *sql.Tx) error {
+		args := make([]interface{}, 0, len(films)*7)
+		for _, film := range films {
+			if err := identity.Map(ctx, tx, identity.Mapping{UUID: film.UUID, LegacyID: film.ID}); err != nil {
+				return err
+			}
+			hash := origin.Hash(film.Title, int(film.Year.Int64))
+			args = append(args, film.ID, film.UUID, film.Title, film.Year, film.LastUpdate, origin.Legacy, hash)
+		}
+		values := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?, ?, ?), ", len(films)), ", ")
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(upsertFilmsSQL, values), args...); err != nil {
+			return fmt.Errorf("an error occured while upserting the films: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, saveCheckpointSQL, checkpointName, films[len(films)-1].ID); err != nil {
+			return fmt.Errorf("an error occured while saving the checkpoint: %w", err)
+		}
+		return nil
+	})
+}
+
+// backfill copies the legacy films that follow the given film ID, chunk by chunk, until there are none left or the
+// given context is done, which stops it once the chunk being written is done.
+func backfill(ctx context.Context, lastID int, t throttle) (int, error) {
+	dbCtx := context.WithoutCancel(ctx)
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		films, err := readChunk(dbCtx, lastID, *chunkSize)
+		if err != nil {
+			return total, err
+		}
+		if len(films) == 0 {
+			return total, nil
+		}
+		if err = identify(dbCtx, films); err != nil {
+			return total, err
+		}
+		if err = writeChunk(dbCtx, films); err != nil {
+			return total, err
+		}
+		lastID = films[len(films)-1].ID
+		total += len(films)
+		logger.Info("chunk backfilled", "films", len(films), "last_film_id", lastID, "total", total)
+		if err = t.wait(ctx); err != nil {
+			return total, err
+		}
+	}
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *chunkSize < 1 {
+		log.Fatalf("the chunk size must be at least 1, got %d", *chunkSize)
+	}
+	t, err := parseThrottle()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := loadConfigurations()
+	logger = createLogger(config.App())
+	catalogueConn = createDBConnection(config.DB())
+	defer catalogueConn.Close()
+	legacyConn = createDBConnection(config.Legacy().DB())
+	defer legacyConn.Close()
+
+	// an interrupted backfill stops once the chunk being written is done, so it resumes from its checkpoint
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	lastID := 0
+	if !*restart {
+		if lastID, err = loadCheckpoint(ctx); err != nil {
+			logger.Error("the backfill could not be started", "error", err)
+			os.Exit(1)
+		}
+	}
+	logger.Info("backfill started", "after_film_id", lastID, "chunk_size", *chunkSize)
+
+	total, err := backfill(ctx, lastID, t)
+	switch {
+	case err == context.Canceled:
+		logger.Info("backfill interrupted", "total", total)
+	case err != nil:
+		logger.Error("the backfill failed", "total", total, "error", err)
+		os.Exit(1)
+	default:
+		logger.Info("backfill finished", "total", total)
+	}
+}
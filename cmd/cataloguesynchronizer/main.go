@@ -1,130 +1,287 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/conflict"
 	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/dedup"
+	"github.com/diegohordi/go-kafka/internal/event"
+	"github.com/diegohordi/go-kafka/internal/health"
+	"github.com/diegohordi/go-kafka/internal/identity"
 	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/legacy"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"github.com/diegohordi/go-kafka/internal/origin"
+	"github.com/diegohordi/go-kafka/internal/outbox"
+	"github.com/diegohordi/go-kafka/internal/tracing"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
-const getFilmByUUIDSQL = "select id from films where uuid = ? or external_id = ?"
-const insertFilmSQL = "insert into films (external_id, uuid, title, year, last_update) select ?, ?, ?, ?, ? where (select count(id) from films where uuid = ?) = 0"
-const updateFilmSQL = "update films set title = ?, year = ?, external_id = ? where uuid = ?"
+const getFilmByUUIDSQL = "select id, uuid, title, year, last_update, sync_origin from films where uuid = ? for update"
+const insertFilmSQL = "insert into films (external_id, uuid, title, year, last_update, sync_origin, sync_hash) select ?, ?, ?, ?, ?, ?, ? where (select count(id) from films where uuid = ?) = 0"
+const updateFilmSQL = "update films set title = ?, year = ?, external_id = ?, sync_origin = ?, sync_hash = ? where uuid = ?"
+const deleteFilmSQL = "delete from films where uuid = ?"
+const linkExternalIDSQL = "update films set external_id = ? where uuid = ? and external_id is null"
+const getFilmsForBatchSQL = "select id, external_id, uuid, title, year, last_update, sync_origin from films where uuid in (%s) for update"
+const upsertFilmsSQL = "insert into films (external_id, uuid, title, year, last_update, sync_origin, sync_hash) values %s on duplicate key update external_id = values(external_id), title = values(title), year = values(year), sync_origin = values(sync_origin), sync_hash = values(sync_hash)"
 
-type Year int
+var configPath = flag.String("config", "", "Config file path")
+var dedupRetention = flag.Duration("dedup-retention", 7*24*time.Hour, "How long the processed events are kept to skip their redeliveries, 0 to keep them forever")
+var dedupPruneInterval = flag.Duration("dedup-prune-interval", time.Hour, "Interval between the prunings of the processed events")
+var dbConn database.Connection
+var logger *slog.Logger
+var conflictHandler *conflict.Handler
 
-func (y *Year) UnmarshalJSON(i []byte) error {
-	value := strings.Trim(string(i), `"`)
-	if value == "" {
-		return nil
-	}
-	time, err := time.Parse("2006-01-02", value)
+// conflictConn is the connection of the conflict store, when it is not dbConn.
+var conflictConn database.Connection
+
+func loadConfigurations() configs.Configurer {
+	config, err := configs.Load(*configPath)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	*y = Year(time.Year())
-	return nil
-}
-
-type Timestamp struct {
-	time.Time
+	return config
 }
 
-func (t *Timestamp) String() string {
-	if t == nil {
-		return ""
+func createLogger(config configs.AppConfigurer) *slog.Logger {
+	logger, err := logging.New(config.LogLevel())
+	if err != nil {
+		log.Fatal(err)
 	}
-	return t.Format(time.RFC3339)
+	return logger
 }
 
-func (t *Timestamp) UnmarshalJSON(i []byte) error {
-	value := strings.Trim(string(i), `"`)
-	if value == "" {
-		return nil
-	}
-	millis, err := strconv.Atoi(value)
+func setupTracing(config configs.TracingConfigurer) tracing.ShutdownFunc {
+	shutdown, err := tracing.Setup(context.Background(), config, "cataloguesynchronizer")
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	time := time.UnixMilli(int64(millis))
+	return shutdown
+}
+
+func createDBConnection(config configs.DBConfigurer) database.Connection {
+	conn, err := database.NewConnection(config)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	t.Time = time
-	return nil
+	return conn
 }
 
-type Film struct {
-	FilmID      int       `json:"film_id"`
-	Title       string    `json:"title"`
-	ReleaseYear Year      `json:"release_year"`
-	LastUpdate  Timestamp `json:"last_update"`
-	UUID        string    `json:"uuid"`
+// createHealthChecker creates the probes of the synchronizer, which is alive while its consumer is not stuck, and
+// ready while its databases and Kafka are reachable.
+func createHealthChecker(config configs.KafkaConfigurer, kafkaClient kafka.Client) *health.Checker {
+	checker := health.NewChecker()
+	checker.AddLiveness("consumer", func(ctx context.Context) error {
+		return kafkaClient.CheckStalled(config.ConsumerStallTimeout())
+	})
+	checker.AddReadiness("db", dbConn.Ping)
+	if conflictConn != nil {
+		checker.AddReadiness("conflict_db", conflictConn.Ping)
+	}
+	checker.AddReadiness("kafka", kafkaClient.Ping)
+	return checker
 }
 
-var configPath = flag.String("config", "", "Config file path")
-var dbConn database.Connection
-
-func loadConfigurations() configs.Configurer {
-	config, err := configs.Load(*configPath)
+func createKafkaClient(config configs.KafkaConfigurer, groupName string) kafka.Client {
+	client, err := kafka.NewClient(config, groupName, kafka.WithLogger(logger))
 	if err != nil {
 		log.Fatal(err)
 	}
-	return config
+	return client
 }
 
-func createDBConnection(config configs.DBConfigurer) database.Connection {
-	conn, err := database.NewConnection(config)
+// createConflictHandler creates the handler of the conflicts detected by the catalogue synchronizer, which are
+// recorded in its own database unless another one is configured.
+func createConflictHandler(config configs.ConflictConfigurer) *conflict.Handler {
+	storeConn := dbConn
+	if config.DSN() != "" {
+		conflictConn = createDBConnection(config.DB())
+		storeConn = conflictConn
+	}
+	handler, err := conflict.NewHandler(config, conflict.NewStore(storeConn), origin.Catalogue, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return conn
+	return handler
 }
 
-func readFilm(key, value []byte) error {
-	r := bytes.NewReader(value)
-	payload := &struct {
-		Payload *Film `json:"payload"`
-	}{}
-	if err := json.NewDecoder(r).Decode(payload); err != nil {
-		return err
+// conflictTx returns the given transaction of the sync when the conflicts are recorded in the same DB, so they are only
+// recorded along with the sync.
+func conflictTx(tx *sql.Tx) *sql.Tx {
+	if conflictConn != nil {
+		return nil
 	}
-	return insertOrUpdate(payload.Payload)
+	return tx
 }
 
-func insertOrUpdate(film *Film) error {
-	ctx, cancel := dbConn.CreateContext(context.TODO())
+// readFilm applies a legacy connector message. Since these messages carry no event ID, they are tracked as processed
+// by their position, in the same transaction of their changes, so a redelivered message is skipped. The catalogue
+// film is found through the identity mapping of the legacy film. Repairs written by the reconciliation are applied
+// without conflict resolution.
+func readFilm(ctx context.Context, msg kafka.Message) error {
+	film, err := legacy.Decode(msg)
+	if err != nil {
+		return err
+	}
+	requestID := msg.Headers[kafka.HeaderRequestID]
+	eventID := dedup.EventID("", msg)
+	eventLogger := logger.With(logging.RequestIDKey, requestID, "event_id", eventID)
+	if msg.Headers[kafka.HeaderRepair] != "" {
+		ctx = conflict.WithRepair(ctx)
+	}
+	ctx, cancel := dbConn.CreateContext(logging.WithRequestID(ctx, requestID))
 	defer cancel()
+	var changedAt time.Time
+	err = dbConn.Transaction(ctx, func(tx *sql.Tx) error {
+		first, err := dedup.Track(ctx, tx, eventID)
+		if err != nil {
+			return err
+		}
+		if !first {
+			eventLogger.Info("event already processed")
+			return nil
+		}
+		if film.DeletedAt != nil {
+			changedAt = film.DeletedAt.Time
+			return deleteFilm(ctx, tx, film)
+		}
+		if err = identify(ctx, tx, film); err != nil {
+			return err
+		}
+		if film.IsEcho() {
+			return suppressEcho(ctx, tx, film)
+		}
+		changedAt = film.LastUpdate.Time
+		return insertOrUpdate(ctx, tx, film)
+	})
+	if err == nil {
+		metrics.ObserveSyncDelay(origin.Legacy, changedAt)
+		eventLogger.Info("event applied", "external_id", film.FilmID)
+	}
+	return err
+}
+
+// suppressEcho drops an event that would only write back what the catalogue already has. The echo of a film created
+// through the API is the first event telling its legacy film ID, so the catalogue film is still linked to it.
+func suppressEcho(ctx context.Context, tx *sql.Tx, film *legacy.Film) error {
+	logger.Info("echo suppressed", "external_id", film.FilmID, "suppressed", origin.SuppressEcho())
+	if _, err := tx.ExecContext(ctx, linkExternalIDSQL, film.FilmID, film.UUID); err != nil {
+		return fmt.Errorf("an error occured while linking the external ID %d: %w", film.FilmID, err)
+	}
+	return nil
+}
+
+// insertOrUpdate applies the given film, traced as a span of the trace of the legacy change.
+func insertOrUpdate(ctx context.Context, tx *sql.Tx, film *legacy.Film) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "insertOrUpdate", trace.WithAttributes(attribute.Int("film.external_id", film.FilmID)))
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
 	var id int
-	err := dbConn.DB().QueryRowContext(ctx, getFilmByUUIDSQL, film.UUID, film.FilmID).Scan(&id)
+	var filmUUID, syncOrigin sql.NullString
+	var title string
+	var year sql.NullInt64
+	var lastUpdate time.Time
+	err = tx.QueryRowContext(ctx, getFilmByUUIDSQL, film.UUID).Scan(&id, &filmUUID, &title, &year, &lastUpdate, &syncOrigin)
 	switch {
 	case err == sql.ErrNoRows:
-		return insert(film)
+		return insert(ctx, tx, film)
 	case err != nil:
 		return fmt.Errorf("an error occured while searching: %w", err)
-	default:
-		return update(film)
+	case origin.Hash(title, int(year.Int64)) == film.Hash():
+		return suppressEcho(ctx, tx, film)
 	}
+	local := conflict.Version{Origin: origin.Catalogue, Title: title, Year: int(year.Int64), LastUpdate: lastUpdate}
+	if syncOrigin.Valid {
+		local.Origin = syncOrigin.String
+	}
+	incoming := conflict.Version{Origin: origin.Legacy, Title: film.Title, Year: int(film.ReleaseYear), LastUpdate: film.LastUpdate.Time}
+	resolved, apply, err := conflictHandler.Handle(ctx, conflictTx(tx), filmUUID.String, film.FilmID, local, incoming)
+	if err != nil || !apply {
+		return err
+	}
+	film.Title = resolved.Title
+	film.ReleaseYear = legacy.Year(resolved.Year)
+	return update(ctx, tx, film)
 }
 
-func insert(film *Film) error {
-	ctx, cancel := dbConn.CreateContext(context.TODO())
-	defer cancel()
-	filmUUID := uuid.New().String()
-	res, err := dbConn.DB().ExecContext(ctx, insertFilmSQL, film.FilmID, filmUUID, film.Title, film.ReleaseYear, film.LastUpdate.Time, film.UUID)
+// identify sets the UUID of the given legacy film from its identity mapping, mapping it when it is seen for the first
+// time.
+func identify(ctx context.Context, tx *sql.Tx, film *legacy.Film) error {
+	m, ok, err := identity.ByLegacyID(ctx, tx, film.FilmID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		film.UUID = m.UUID
+		return nil
+	}
+	return assignIdentity(ctx, tx, film)
+}
+
+// identifyFilms sets the UUID of each of the given legacy films from its identity mapping, mapping the ones seen for
+// the first time.
+func identifyFilms(ctx context.Context, tx *sql.Tx, films []*legacy.Film) error {
+	ids := make([]int, 0, len(films))
+	for _, film := range films {
+		ids = append(ids, film.FilmID)
+	}
+	mappings, err := identity.ByLegacyIDs(ctx, tx, ids)
+	if err != nil {
+		return err
+	}
+	for _, film := range films {
+		if m, ok := mappings[film.FilmID]; ok {
+			film.UUID = m.UUID
+			continue
+		}
+		if err = assignIdentity(ctx, tx, film); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignIdentity maps the given legacy film, seen for the first time, to the UUID it carries when it was created
+// through the API, or to a new UUID otherwise. A new UUID is written back to the legacy row through the catalogue
+// topic, so later changes of the film made through the API find it in the legacy DB.
+func assignIdentity(ctx context.Context, tx *sql.Tx, film *legacy.Film) error {
+	assigned := film.UUID == ""
+	if assigned {
+		film.UUID = uuid.New().String()
+	}
+	m := identity.Mapping{UUID: film.UUID, LegacyID: film.FilmID}
+	if err := identity.Map(ctx, tx, m); err != nil {
+		return err
+	}
+	if !assigned {
+		return nil
+	}
+	e, err := event.New(event.FilmIdentityAssigned, origin.Catalogue, m)
+	if err != nil {
+		return err
+	}
+	return outbox.Enqueue(ctx, tx, film.UUID, e)
+}
+
+func insert(ctx context.Context, tx *sql.Tx, film *legacy.Film) error {
+	res, err := tx.ExecContext(ctx, insertFilmSQL, film.FilmID, film.UUID, film.Title, film.ReleaseYear, film.LastUpdate.Time, origin.Legacy, film.Hash(), film.UUID)
 	if err != nil {
 		return fmt.Errorf("an error occured while inserting: %w", err)
 	}
@@ -138,10 +295,8 @@ func insert(film *Film) error {
 	return nil
 }
 
-func update(film *Film) error {
-	ctx, cancel := dbConn.CreateContext(context.TODO())
-	defer cancel()
-	res, err := dbConn.DB().ExecContext(ctx, updateFilmSQL, film.Title, film.ReleaseYear, film.FilmID, film.UUID)
+func update(ctx context.Context, tx *sql.Tx, film *legacy.Film) error {
+	res, err := tx.ExecContext(ctx, updateFilmSQL, film.Title, film.ReleaseYear, film.FilmID, origin.Legacy, film.Hash(), film.UUID)
 	if err != nil {
 		return fmt.Errorf("an error occured while updating: %w", err)
 	}
@@ -155,40 +310,275 @@ func update(film *Film) error {
 	return nil
 }
 
+// filmRow is a catalogue film locked by a batch.
+type filmRow struct {
+	id         int
+	externalID sql.NullInt64
+	uuid       sql.NullString
+	title      string
+	year       sql.NullInt64
+	lastUpdate time.Time
+	syncOrigin sql.NullString
+}
+
+// readFilms applies a batch of legacy connector messages in a single transaction. Every message is tracked as
+// processed, but only the latest change of each film is applied, and all the inserted or updated films are written
+// by a single upsert. Repairs are applied without conflict resolution, as by readFilm.
+func readFilms(ctx context.Context, msgs []kafka.Message) error {
+	films := make([]*legacy.Film, 0, len(msgs))
+	for _, msg := range msgs {
+		film, err := legacy.Decode(msg)
+		if err != nil {
+			return err
+		}
+		films = append(films, film)
+	}
+	ctx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	var changed []*legacy.Film
+	err := dbConn.Transaction(ctx, func(tx *sql.Tx) error {
+		latest := make(map[int]*legacy.Film)
+		repairs := make(map[int]bool)
+		var order []int
+		var live []*legacy.Film
+		for i, msg := range msgs {
+			eventID := dedup.EventID("", msg)
+			first, err := dedup.Track(ctx, tx, eventID)
+			if err != nil {
+				return err
+			}
+			if !first {
+				logger.Info("event already processed", logging.RequestIDKey, msg.Headers[kafka.HeaderRequestID], "event_id", eventID)
+				continue
+			}
+			if _, ok := latest[films[i].FilmID]; !ok {
+				order = append(order, films[i].FilmID)
+			}
+			latest[films[i].FilmID] = films[i]
+			repairs[films[i].FilmID] = msg.Headers[kafka.HeaderRepair] != ""
+		}
+		for _, filmID := range order {
+			if film := latest[filmID]; film.DeletedAt == nil {
+				live = append(live, film)
+			}
+		}
+		if err := identifyFilms(ctx, tx, live); err != nil {
+			return err
+		}
+		for _, filmID := range order {
+			film := latest[filmID]
+			switch {
+			case film.DeletedAt != nil:
+				if err := deleteFilm(ctx, tx, film); err != nil {
+					return err
+				}
+			case film.IsEcho():
+				if err := suppressEcho(ctx, tx, film); err != nil {
+					return err
+				}
+			default:
+				changed = append(changed, film)
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		rows, err := lockFilms(ctx, tx, changed)
+		if err != nil {
+			return err
+		}
+		var upserts []*legacy.Film
+		for _, film := range changed {
+			filmCtx := ctx
+			if repairs[film.FilmID] {
+				filmCtx = conflict.WithRepair(ctx)
+			}
+			apply, err := resolveBatchFilm(filmCtx, tx, film, rows)
+			if err != nil {
+				return err
+			}
+			if apply {
+				upserts = append(upserts, film)
+			}
+		}
+		return upsertFilms(ctx, tx, upserts)
+	})
+	if err == nil {
+		for _, film := range changed {
+			metrics.ObserveSyncDelay(origin.Legacy, film.LastUpdate.Time)
+		}
+	}
+	return err
+}
+
+// lockFilms locks the catalogue films of the given identified legacy films, indexing them by their UUID.
+func lockFilms(ctx context.Context, tx *sql.Tx, films []*legacy.Film) (map[string]*filmRow, error) {
+	uuids := make([]interface{}, 0, len(films))
+	for _, film := range films {
+		uuids = append(uuids, film.UUID)
+	}
+	query := fmt.Sprintf(getFilmsForBatchSQL, placeholders(len(uuids)))
+	res, err := tx.QueryContext(ctx, query, uuids...)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while searching: %w", err)
+	}
+	defer res.Close()
+	rows := make(map[string]*filmRow)
+	for res.Next() {
+		row := &filmRow{}
+		if err = res.Scan(&row.id, &row.externalID, &row.uuid, &row.title, &row.year, &row.lastUpdate, &row.syncOrigin); err != nil {
+			return nil, fmt.Errorf("an error occured while searching: %w", err)
+		}
+		rows[row.uuid.String] = row
+	}
+	return rows, res.Err()
+}
+
+// resolveBatchFilm compares the given legacy film to its catalogue film, just like insertOrUpdate, telling whether it
+// must be written. Films that are not in the catalogue yet are inserted.
+func resolveBatchFilm(ctx context.Context, tx *sql.Tx, film *legacy.Film, rows map[string]*filmRow) (bool, error) {
+	row, ok := rows[film.UUID]
+	if !ok {
+		return true, nil
+	}
+	if origin.Hash(row.title, int(row.year.Int64)) == film.Hash() {
+		return false, suppressEcho(ctx, tx, film)
+	}
+	local := conflict.Version{Origin: origin.Catalogue, Title: row.title, Year: int(row.year.Int64), LastUpdate: row.lastUpdate}
+	if row.syncOrigin.Valid {
+		local.Origin = row.syncOrigin.String
+	}
+	incoming := conflict.Version{Origin: origin.Legacy, Title: film.Title, Year: int(film.ReleaseYear), LastUpdate: film.LastUpdate.Time}
+	resolved, apply, err := conflictHandler.Handle(ctx, conflictTx(tx), row.uuid.String, film.FilmID, local, incoming)
+	if err != nil || !apply {
+		return false, err
+	}
+	film.Title = resolved.Title
+	film.ReleaseYear = legacy.Year(resolved.Year)
+	return true, nil
+}
+
+// upsertFilms inserts or updates the given films with a single statement, relying on the unique external ID and UUID
+// of the catalogue films.
+func upsertFilms(ctx context.Context, tx *sql.Tx, films []*legacy.Film) error {
+	if len(films) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(films))
+	args := make([]interface{}, 0, len(films)*7)
+	for _, film := range films {
+		values = append(values, "("+placeholders(7)+")")
+		args = append(args, film.FilmID, film.UUID, film.Title, film.ReleaseYear, film.LastUpdate.Time, origin.Legacy, film.Hash())
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(upsertFilmsSQL, strings.Join(values, ", ")), args...); err != nil {
+		return fmt.Errorf("an error occured while upserting %d films: %w", len(films), err)
+	}
+	return nil
+}
+
+// placeholders returns n comma separated query placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// deleteFilm removes the catalogue film of the legacy film flagged as deleted. Films never mapped nor synced, or
+// already removed, are ignored.
+func deleteFilm(ctx context.Context, tx *sql.Tx, film *legacy.Film) error {
+	m, ok, err := identity.ByLegacyID(ctx, tx, film.FilmID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		film.UUID = m.UUID
+	}
+	if film.UUID == "" {
+		return nil
+	}
+	if _, err = tx.ExecContext(ctx, deleteFilmSQL, film.UUID); err != nil {
+		return fmt.Errorf("an error occured while deleting: %w", err)
+	}
+	return nil
+}
+
 func main() {
 
 	flag.Parse()
 	config := loadConfigurations()
+	logger = createLogger(config.App())
+	shutdownTracing := setupTracing(config.Tracing())
 	dbConn = createDBConnection(config.DB())
+	conflictHandler = createConflictHandler(config.Conflict())
 
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	kafkaClient := kafka.NewClient(config.Kafka(), "films")
-
-	ctx := context.Background()
+	kafkaClient := createKafkaClient(config.Kafka(), "films")
 
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	pruned := make(chan struct{})
 	go func() {
-
-		for {
-			err := kafkaClient.Read(ctx, readFilm)
-			if err != nil {
-				log.Println(err)
-			}
+		defer close(pruned)
+		if *dedupRetention > 0 {
+			dedup.RunPruner(consumerCtx, dbConn, *dedupRetention, *dedupPruneInterval, logger)
+		}
+	}()
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		var err error
+		if config.Kafka().ConsumerBatchSize() > 0 {
+			err = kafkaClient.ConsumeBatch(consumerCtx, readFilms)
+		} else {
+			err = kafkaClient.Consume(consumerCtx, readFilm)
+		}
+		if err != nil && err != context.Canceled {
+			logger.Error("the consumer stopped", "error", err)
 		}
-
 	}()
 
-	log.Println("catalogue consumer started")
+	checker := createHealthChecker(config.Kafka(), kafkaClient)
+	metricsSrv := metrics.Serve(config.App().Port(), map[string]http.Handler{
+		"/livez":  checker.Liveness(),
+		"/readyz": checker.Readiness(),
+	})
 
-	<-exit
-	log.Println("server stopped")
+	logger.Info("catalogue consumer started")
 
-	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer func() {
-		kafkaClient.Close()
-		cancel()
-	}()
+	// a consumer that stops on its own, which only happens on an unexpected error, stops the synchronizer
+	failed := false
+	select {
+	case <-exit:
+		logger.Info("server stopped")
+	case <-consumed:
+		failed = true
+	}
+
+	stopConsumer()
+	drained := true
+	select {
+	case <-consumed:
+	case <-time.After(config.App().DrainTimeout()):
+		drained = false
+		logger.Error("the messages being processed were not drained", "drain_timeout", config.App().DrainTimeout())
+	}
+	<-pruned
 
-	log.Println("consumer shutdown successfully")
+	if err := metricsSrv.Close(); err != nil {
+		logger.Error("could not close the metrics server", "error", err)
+	}
+	kafkaClient.Close()
+	if conflictConn != nil {
+		conflictConn.Close()
+	}
+	dbConn.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.App().ShutdownTimeout())
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("could not flush the traces", "error", err)
+	}
+	cancel()
+
+	if !drained || failed {
+		os.Exit(1)
+	}
+	logger.Info("consumer shutdown successfully")
 }
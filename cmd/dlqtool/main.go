@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/event"
+	"github.com/diegohordi/go-kafka/internal/kafka"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: dlqtool <list|replay> [flags]
+
+Lists or replays the film events parked in the dead-letter topic of the given configuration.
+
+Flags:
+`
+
+var configPath = flag.String("config", "", "Config file path")
+var filmUUID = flag.String("uuid", "", "Only the events of the film with the given UUID")
+var externalID = flag.Int("external-id", 0, "Only the events of the film with the given legacy film ID")
+var since = flag.String("since", "", "Only the events failed at or after the given RFC3339 time")
+var until = flag.String("until", "", "Only the events failed before the given RFC3339 time")
+var offsets = flag.String("offsets", "", "Only the events at the given comma separated dead-letter offsets, as partition/offset or offset")
+var replayTopic = flag.String("topic", "", "Topic to replay the events onto, instead of the topic each of them came from")
+var dryRun = flag.Bool("dry-run", false, "Only list the events that would be replayed")
+
+// deadLetterView is the listed view of a dead letter.
+type deadLetterView struct {
+	Partition         int       `json:"partition"`
+	Offset            int64     `json:"offset"`
+	FilmUUID          string    `json:"film_uuid,omitempty"`
+	ExternalID        int       `json:"external_id,omitempty"`
+	Topic             string    `json:"topic"`
+	OriginalPartition int       `json:"original_partition"`
+	OriginalOffset    int64     `json:"original_offset"`
+	Error             string    `json:"error"`
+	Attempts          int       `json:"attempts"`
+	FailedAt          time.Time `json:"failed_at"`
+	Key               string    `json:"key,omitempty"`
+	Value             string    `json:"value,omitempty"`
+}
+
+// filter selects the dead letters to be listed or replayed.
+type filter struct {
+	filmUUID   string
+	externalID int
+	since      time.Time
+	until      time.Time
+	offsets    map[string]bool
+}
+
+func loadConfigurations() configs.Configurer {
+	config, err := configs.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+func parseFilter() (filter, error) {
+	f := filter{filmUUID: *filmUUID, externalID: *externalID}
+	var err error
+	if *since != "" {
+		if f.since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return filter{}, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if *until != "" {
+		if f.until, err = time.Parse(time.RFC3339, *until); err != nil {
+			return filter{}, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if *offsets != "" {
+		f.offsets = make(map[string]bool)
+		for _, offset := range strings.Split(*offsets, ",") {
+			f.offsets[strings.TrimSpace(offset)] = true
+		}
+	}
+	return f, nil
+}
+
+func (f filter) match(e deadLetterView) bool {
+	switch {
+	case f.filmUUID != "" && e.FilmUUID != f.filmUUID:
+		return false
+	case f.externalID != 0 && e.ExternalID != f.externalID:
+		return false
+	case !f.since.IsZero() && e.FailedAt.Before(f.since):
+		return false
+	case !f.until.IsZero() && !e.FailedAt.Before(f.until):
+		return false
+	case f.offsets != nil:
+		return f.offsets[strconv.FormatInt(e.Offset, 10)] || f.offsets[fmt.Sprintf("%d/%d", e.Partition, e.Offset)]
+	default:
+		return true
+	}
+}
+
+// newDeadLetterView creates the view of the given dead letter, identifying the film from the catalogue events, from their
+// tombstones and from the legacy connector messages, whose payload field is decoded just like an envelope payload.
+func newDeadLetterView(letter kafka.DeadLetter) deadLetterView {
+	e := deadLetterView{
+		Partition:         letter.Partition,
+		Offset:            letter.Offset,
+		Topic:             letter.Topic,
+		OriginalPartition: letter.OriginalPartition,
+		OriginalOffset:    letter.OriginalOffset,
+		Error:             letter.Error,
+		Attempts:          letter.Attempts,
+		FailedAt:          letter.FailedAt,
+		Key:               string(letter.Key),
+		Value:             string(letter.Value),
+	}
+	if len(letter.Value) == 0 {
+		e.FilmUUID = string(letter.Key)
+		return e
+	}
+	envelope, err := event.Decode(letter.Key, letter.Value)
+	if err != nil {
+		return e
+	}
+	film := &struct {
+		UUID   string `json:"uuid"`
+		FilmID int    `json:"film_id"`
+	}{}
+	if err = envelope.Unmarshal(film); err != nil {
+		return e
+	}
+	e.FilmUUID, e.ExternalID = film.UUID, film.FilmID
+	return e
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command := os.Args[1]
+	if err := flag.CommandLine.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+	if command != "list" && command != "replay" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := loadConfigurations()
+	f, err := parseFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	letters, err := kafka.ReadDeadLetters(ctx, config.Kafka())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var selected []kafka.DeadLetter
+	encoder := json.NewEncoder(os.Stdout)
+	for _, letter := range letters {
+		e := newDeadLetterView(letter)
+		if !f.match(e) {
+			continue
+		}
+		selected = append(selected, letter)
+		_ = encoder.Encode(e)
+	}
+
+	if command == "list" {
+		return
+	}
+	if *dryRun {
+		log.Printf("%d events would be replayed\n", len(selected))
+		return
+	}
+	if len(selected) == 0 {
+		log.Println("no events to replay")
+		return
+	}
+	if err = kafka.ReplayDeadLetters(ctx, config.Kafka(), *replayTopic, selected); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d events replayed\n", len(selected))
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/binlog"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/health"
+	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/legacy"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"github.com/go-sql-driver/mysql"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage: legacycdc [flags]
+
+Tails the binlog of the legacy DB (db.dsn) as a replica, publishing the changes of its film table onto the topic the
+connector publishes to (kafka.topic), as the connector does. The binlog position is saved once the changes of a
+transaction are published, so a restarted publisher resumes right after the last published transaction.
+
+Flags:
+`
+
+const positionName = "film"
+
+const getPositionSQL = "select file, position, gtid_set from binlog_positions where name = ?"
+const savePositionSQL = "insert into binlog_positions (name, file, position, gtid_set) values (?, ?, ?, ?) on duplicate key update file = values(file), position = values(position), gtid_set = values(gtid_set)"
+const getColumnsSQL = "select column_name from information_schema.columns where table_schema = ? and table_name = ? order by ordinal_position"
+
+var configPath = flag.String("config", "", "Config file path")
+var serverID = flag.Uint("server-id", 1001, "Replica server ID of the publisher, unique among the replicas of the legacy DB")
+var heartbeat = flag.Duration("heartbeat", 30*time.Second, "Heartbeat period asked to the legacy DB, which is considered gone after two periods of silence")
+var saveInterval = flag.Duration("save-interval", 10*time.Second, "Interval the position is saved at while the transactions read change no film")
+var maxBackoff = flag.Duration("max-backoff", time.Minute, "Maximum wait before reconnecting to the legacy DB")
+
+var dbConn database.Connection
+var logger *slog.Logger
+var writer kafka.WriteCloser
+var streamConfig binlog.Config
+
+// schema is the name of the legacy DB, whose film table is tailed.
+var schema string
+
+// columns are the names of the columns of the film table, in the order of the row images.
+var columns []string
+
+// connected tells whether the binlog is being streamed.
+var connected atomic.Bool
+
+func loadConfigurations() configs.Configurer {
+	config, err := configs.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+func createLogger(config configs.AppConfigurer) *slog.Logger {
+	logger, err := logging.New(config.LogLevel())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return logger
+}
+
+func createDBConnection(config configs.DBConfigurer) database.Connection {
+	conn, err := database.NewConnection(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn
+}
+
+func createKafkaWriter(config configs.KafkaConfigurer) kafka.WriteCloser {
+	writer, err := kafka.NewWriter(config, config.Topic(), kafka.WithLogger(logger))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return writer
+}
+
+// createHealthChecker creates the probes of the publisher, which is ready while the binlog is streamed and the legacy
+// DB, where the position is saved, is reachable.
+func createHealthChecker() *health.Checker {
+	checker := health.NewChecker()
+	checker.AddReadiness("db", dbConn.Ping)
+	checker.AddReadiness("binlog", func(ctx context.Context) error {
+		if !connected.Load() {
+			return fmt.Errorf("the binlog is not being streamed")
+		}
+		return nil
+	})
+	return checker
+}
+
+// loadPosition loads the position saved by the last run, or an empty one when there is none, so the binlog is streamed
+// from the current position of the legacy DB.
+func loadPosition(ctx context.Context) (binlog.Position, error) {
+	ctx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	var position binlog.Position
+	var gtidSet sql.NullString
+	err := dbConn.DB().QueryRowContext(ctx, getPositionSQL, positionName).Scan(&position.File, &position.Pos, &gtidSet)
+	if err == sql.ErrNoRows {
+		return binlog.Position{}, nil
+	}
+	if err != nil {
+		return binlog.Position{}, fmt.Errorf("an error occured while loading the binlog position: %w", err)
+	}
+	position.GTIDSet = gtidSet.String
+	return position, nil
+}
+
+func savePosition(ctx context.Context, position binlog.Position) error {
+	ctx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	gtidSet := sql.NullString{String: position.GTIDSet, Valid: position.GTIDSet != ""}
+	if _, err := dbConn.DB().ExecContext(ctx, savePositionSQL, positionName, position.File, position.Pos, gtidSet); err != nil {
+		return fmt.Errorf("an error occured while saving the binlog position: %w", err)
+	}
+	return nil
+}
+
+// loadColumns loads the names of the columns of the film table, which the row events do not carry.
+func loadColumns(ctx context.Context) error {
+	ctx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	rows, err := dbConn.DB().QueryContext(ctx, getColumnsSQL, schema, "film")
+	if err != nil {
+		return fmt.Errorf("an error occured while loading the film columns: %w", err)
+	}
+	defer rows.Close()
+	loaded := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return fmt.Errorf("an error occured while loading the film columns: %w", err)
+		}
+		loaded = append(loaded, name)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("an error occured while loading the film columns: %w", err)
+	}
+	columns = loaded
+	return nil
+}
+
+// newFilm maps the image of a film row to the film the connector would publish.
+func newFilm(row []interface{}) *legacy.Film {
+	film := &legacy.Film{}
+	for i, name := range columns {
+		switch value := row[i].(type) {
+		case uint64:
+			switch name {
+			case "film_id":
+				film.FilmID = int(value)
+			case "release_year":
+				film.ReleaseYear = legacy.Year(value)
+			}
+		case string:
+			switch name {
+			case "title":
+				film.Title = value
+			case "uuid":
+				film.UUID = value
+			case "sync_origin":
+				film.SyncOrigin = value
+			case "sync_hash":
+				film.SyncHash = value
+			}
+		case time.Time:
+			switch name {
+			case "last_update":
+				film.LastUpdate = legacy.Timestamp{Time: value}
+			case "deleted_at":
+				film.DeletedAt = &legacy.Timestamp{Time: value}
+			}
+		}
+	}
+	return film
+}
+
+// changed tells whether an update changed the film as the catalogue sees it, so the writes that only touch other
+// columns, such as the UUID written back by the synchronizer, are not published.
+func changed(before, after *legacy.Film) bool {
+	return before.Title != after.Title || before.ReleaseYear != after.ReleaseYear || (before.DeletedAt == nil) != (after.DeletedAt == nil)
+}
+
+// filmMessages returns the messages of the films changed by a rows event. Deleted rows are published as films deleted
+// when the rows were, since the connector never sees them.
+func filmMessages(ctx context.Context, e binlog.Event) ([]kafka.Message, error) {
+	rows := e.Rows.Rows
+	if len(rows) > 0 && len(rows[0]) != len(columns) {
+		// the table was altered since the columns were loaded
+		if err := loadColumns(ctx); err != nil {
+			return nil, err
+		}
+		if len(rows[0]) != len(columns) {
+			return nil, fmt.Errorf("the film rows have %d columns while the table has %d", len(rows[0]), len(columns))
+		}
+	}
+	films := make([]*legacy.Film, 0, len(rows))
+	switch e.Rows.Action {
+	case binlog.Insert:
+		for _, row := range rows {
+			films = append(films, newFilm(row))
+		}
+	case binlog.Update:
+		for i := 0; i+1 < len(rows); i += 2 {
+			before, after := newFilm(rows[i]), newFilm(rows[i+1])
+			if changed(before, after) {
+				films = append(films, after)
+			}
+		}
+	case binlog.Delete:
+		for _, row := range rows {
+			film := newFilm(row)
+			if film.DeletedAt == nil {
+				film.DeletedAt = &legacy.Timestamp{Time: e.Timestamp}
+			}
+			films = append(films, film)
+		}
+	}
+	msgs := make([]kafka.Message, 0, len(films))
+	for _, film := range films {
+		msg, err := legacy.Encode(film)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// tail streams the binlog from the given position until the context is cancelled or the stream fails, publishing the
+// film changes of every transaction once it is committed. The position is moved past every transaction read, and saved
+// once its changes are published, or every save interval otherwise, so it is not left behind in a purged binlog file.
+func tail(ctx context.Context, position *binlog.Position) error {
+	stream, err := binlog.Open(ctx, streamConfig, *position)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = stream.Close()
+	})
+	defer func() {
+		if stop() {
+			_ = stream.Close()
+		}
+		connected.Store(false)
+	}()
+	connected.Store(true)
+	logger.Info("binlog streamed", "file", stream.Position().File, "position", stream.Position().Pos, "gtid_set", stream.Position().GTIDSet)
+	savedAt := time.Now()
+	var pending []kafka.Message
+	for {
+		e, err := stream.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if e.Rows != nil && e.Rows.Schema == schema && e.Rows.Table == "film" {
+			msgs, err := filmMessages(ctx, e)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, msgs...)
+		}
+		if !e.Commit {
+			continue
+		}
+		// the messages are published even when the publisher is being stopped, so the position can be saved past them
+		if len(pending) > 0 {
+			if err = writer.WriteMessages(context.WithoutCancel(ctx), pending...); err != nil {
+				return fmt.Errorf("an error occured while publishing the film changes: %w", err)
+			}
+			logger.Info("film changes published", "count", len(pending), "file", e.Position.File, "position", e.Position.Pos)
+		}
+		*position = e.Position
+		if len(pending) > 0 || time.Since(savedAt) >= *saveInterval {
+			if err = savePosition(context.WithoutCancel(ctx), *position); err != nil {
+				return err
+			}
+			savedAt = time.Now()
+		}
+		pending = nil
+	}
+}
+
+// run tails the binlog until the context is cancelled, reconnecting with an exponential backoff whenever the stream
+// fails, unless the legacy DB does not log full row images. A transaction interrupted by a failure is read again from
+// its start.
+func run(ctx context.Context) error {
+	position, err := loadPosition(ctx)
+	if err != nil {
+		return err
+	}
+	if err = loadColumns(ctx); err != nil {
+		return err
+	}
+	backoff := time.Second
+	for {
+		startedAt := time.Now()
+		err = tail(ctx, &position)
+		if ctx.Err() != nil {
+			// the position of the last transaction read is saved, since it may not have been yet
+			if position.File != "" || position.GTIDSet != "" {
+				return savePosition(context.WithoutCancel(ctx), position)
+			}
+			return nil
+		}
+		if errors.Is(err, binlog.ErrUnsupportedBinlog) {
+			return err
+		}
+		if time.Since(startedAt) > *maxBackoff {
+			backoff = time.Second
+		}
+		logger.Error("the binlog stream failed", "error", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > *maxBackoff {
+			backoff = *maxBackoff
+		}
+	}
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	config := loadConfigurations()
+	logger = createLogger(config.App())
+	dbConn = createDBConnection(config.DB())
+	dsn, err := mysql.ParseDSN(config.DB().DSN())
+	if err != nil {
+		log.Fatal(err)
+	}
+	schema = dsn.DBName
+	streamConfig = binlog.Config{
+		DSN:             config.DB().DSN(),
+		ServerID:        uint32(*serverID),
+		HeartbeatPeriod: *heartbeat,
+		Tables:          []string{schema + ".film"},
+	}
+	writer = createKafkaWriter(config.Kafka())
+
+	checker := createHealthChecker()
+	metricsSrv := metrics.Serve(config.App().Port(), map[string]http.Handler{
+		"/livez":  checker.Liveness(),
+		"/readyz": checker.Readiness(),
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("legacy CDC started", "schema", schema, "topic", config.Kafka().Topic())
+	err = run(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error("the legacy CDC stopped", "error", err)
+	}
+
+	if err := metricsSrv.Close(); err != nil {
+		logger.Error("could not close the metrics server", "error", err)
+	}
+	writer.Close()
+	dbConn.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+	logger.Info("legacy CDC shutdown successfully")
+}
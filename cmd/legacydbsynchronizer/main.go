@@ -1,29 +1,54 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/diegohordi/go-kafka/internal/catalogue"
 	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/conflict"
 	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/dedup"
+	"github.com/diegohordi/go-kafka/internal/event"
+	"github.com/diegohordi/go-kafka/internal/health"
+	"github.com/diegohordi/go-kafka/internal/identity"
 	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"github.com/diegohordi/go-kafka/internal/origin"
+	"github.com/diegohordi/go-kafka/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
-const getFilmByUUIDSQL = "select film_id from film where uuid = ?"
-const insertFilmSQL = "insert into film (uuid, language_id, title, release_year, last_update) select ?, 1, ?, ?, ? where (select count(film_id) from film where uuid = ?) = 0"
-const updateFilmSQL = "update film set title = ?, release_year = ? where uuid = ?"
+const getFilmByIDSQL = "select film_id, title, release_year, last_update, sync_origin, sync_hash from film where film_id = ? for update"
+const insertFilmSQL = "insert into film (uuid, language_id, title, release_year, last_update, sync_origin, sync_hash) select ?, 1, ?, ?, ?, ?, ? where (select count(film_id) from film where uuid = ?) = 0"
+const updateFilmSQL = "update film set title = ?, release_year = ?, sync_origin = ?, sync_hash = ? where film_id = ?"
+const getFilmIDForDeleteSQL = "select film_id from film where film_id = ? for update"
+const assignFilmUUIDSQL = "update film set uuid = ?, last_update = last_update where film_id = ?"
+const countFilmInventorySQL = "select count(inventory_id) from inventory where film_id = ?"
+const flagFilmAsDeletedSQL = "update film set deleted_at = ? where film_id = ? and deleted_at is null"
+const deleteFilmActorsSQL = "delete from film_actor where film_id = ?"
+const deleteFilmCategoriesSQL = "delete from film_category where film_id = ?"
+const deleteFilmSQL = "delete from film where film_id = ?"
 
 var configPath = flag.String("config", "", "Config file path")
+var dedupRetention = flag.Duration("dedup-retention", 7*24*time.Hour, "How long the processed events are kept to skip their redeliveries, 0 to keep them forever")
+var dedupPruneInterval = flag.Duration("dedup-prune-interval", time.Hour, "Interval between the prunings of the processed events")
 var dbConn database.Connection
+var logger *slog.Logger
+var conflictHandler *conflict.Handler
+
+// conflictConn is the connection of the conflict store, when it is not dbConn.
+var conflictConn database.Connection
 
 func loadConfigurations() configs.Configurer {
 	config, err := configs.Load(*configPath)
@@ -33,6 +58,22 @@ func loadConfigurations() configs.Configurer {
 	return config
 }
 
+func createLogger(config configs.AppConfigurer) *slog.Logger {
+	logger, err := logging.New(config.LogLevel())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return logger
+}
+
+func setupTracing(config configs.TracingConfigurer) tracing.ShutdownFunc {
+	shutdown, err := tracing.Setup(context.Background(), config, "legacydbsynchronizer")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return shutdown
+}
+
 func createDBConnection(config configs.DBConfigurer) database.Connection {
 	conn, err := database.NewConnection(config)
 	if err != nil {
@@ -41,35 +82,180 @@ func createDBConnection(config configs.DBConfigurer) database.Connection {
 	return conn
 }
 
-func readFilm(key, value []byte) error {
-	r := bytes.NewReader(value)
-	film := &catalogue.Film{}
-	if err := json.NewDecoder(r).Decode(film); err != nil {
-		return err
+// createHealthChecker creates the probes of the synchronizer, which is alive while its consumer is not stuck, and
+// ready while its databases and Kafka are reachable.
+func createHealthChecker(config configs.KafkaConfigurer, kafkaClient kafka.Client) *health.Checker {
+	checker := health.NewChecker()
+	checker.AddLiveness("consumer", func(ctx context.Context) error {
+		return kafkaClient.CheckStalled(config.ConsumerStallTimeout())
+	})
+	checker.AddReadiness("db", dbConn.Ping)
+	if conflictConn != nil {
+		checker.AddReadiness("conflict_db", conflictConn.Ping)
 	}
-	return insertOrUpdate(film)
+	checker.AddReadiness("kafka", kafkaClient.Ping)
+	return checker
 }
 
-func insertOrUpdate(film *catalogue.Film) error {
-	ctx, cancel := dbConn.CreateContext(context.TODO())
+func createKafkaClient(config configs.KafkaConfigurer, groupName string) kafka.Client {
+	client, err := kafka.NewClient(config, groupName, kafka.WithLogger(logger))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
+
+// createConflictHandler creates the handler of the conflicts detected by the legacy DB synchronizer, which are
+// recorded in the catalogue DB when it is configured, and only logged otherwise.
+func createConflictHandler(config configs.ConflictConfigurer) *conflict.Handler {
+	var store *conflict.Store
+	if config.DSN() != "" {
+		conflictConn = createDBConnection(config.DB())
+		store = conflict.NewStore(conflictConn)
+	}
+	handler, err := conflict.NewHandler(config, store, origin.Legacy, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return handler
+}
+
+// readFilm applies a catalogue event, either enveloped or written before the envelope existed. Deletions, whether
+// tombstones or FilmDeleted events, are keyed by the film UUID. The event is tracked as processed in the same
+// transaction of its changes, so a redelivered event is skipped. The delay between the catalogue change and its apply
+// is recorded once committed. Every log line carries the ID of the request that caused the event, if any. Repairs
+// written by the reconciliation are applied without conflict resolution.
+func readFilm(ctx context.Context, msg kafka.Message) error {
+	e, err := event.Decode(msg.Key, msg.Value)
+	if err != nil {
+		return err
+	}
+	requestID := msg.Headers[kafka.HeaderRequestID]
+	eventID := dedup.EventID(e.ID, msg)
+	eventLogger := logger.With(logging.RequestIDKey, requestID, "event_id", eventID, "event_type", e.Type)
+	if msg.Headers[kafka.HeaderRepair] != "" {
+		ctx = conflict.WithRepair(ctx)
+	}
+	ctx, cancel := dbConn.CreateContext(logging.WithRequestID(ctx, requestID))
 	defer cancel()
+	var changedAt time.Time
+	err = dbConn.Transaction(ctx, func(tx *sql.Tx) error {
+		first, err := dedup.Track(ctx, tx, eventID)
+		if err != nil {
+			return err
+		}
+		if !first {
+			eventLogger.Info("event already processed")
+			return nil
+		}
+		if e.Type == event.FilmDeleted {
+			changedAt = e.OccurredAt
+			return deleteFilm(ctx, tx, e.Key)
+		}
+		if e.Type == event.FilmIdentityAssigned {
+			m := identity.Mapping{}
+			if err = e.Unmarshal(&m); err != nil {
+				return err
+			}
+			return assignUUID(ctx, tx, m)
+		}
+		film := &catalogue.SyncFilm{}
+		if err = e.Unmarshal(film); err != nil {
+			return err
+		}
+		if e.Source != "" {
+			film.Origin = e.Source
+		}
+		if film.UpdatedAt.IsZero() {
+			film.UpdatedAt = e.OccurredAt
+		}
+		if film.Hash == "" {
+			film.Hash = origin.Hash(film.Title, film.Year)
+		}
+		if film.Origin == origin.Legacy {
+			suppressEcho(eventLogger, film)
+			return nil
+		}
+		changedAt = film.UpdatedAt
+		return insertOrUpdate(ctx, tx, eventLogger, film)
+	})
+	if err == nil {
+		metrics.ObserveSyncDelay(origin.Catalogue, changedAt)
+		eventLogger.Info("event applied", "film_uuid", e.Key)
+	}
+	return err
+}
+
+// suppressEcho drops an event that would only write back what the legacy DB already has.
+func suppressEcho(logger *slog.Logger, film *catalogue.SyncFilm) {
+	logger.Info("echo suppressed", "film_uuid", film.UUID, "suppressed", origin.SuppressEcho())
+}
+
+// assignUUID writes back the UUID the catalogue assigned to a film created in the legacy DB, keeping its last update,
+// so the change is not published by the connector again.
+func assignUUID(ctx context.Context, tx *sql.Tx, m identity.Mapping) error {
+	if err := identity.Map(ctx, tx, m); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, assignFilmUUIDSQL, m.UUID, m.LegacyID); err != nil {
+		return fmt.Errorf("an error occured while assigning the UUID %s: %w", m.UUID, err)
+	}
+	return nil
+}
+
+// insertOrUpdate applies the given film, traced as a span of the trace of the catalogue change. The legacy film is
+// found through the identity mapping of the catalogue film. Mapped films missing from the legacy DB are taken as
+// deleted, and skipped.
+func insertOrUpdate(ctx context.Context, tx *sql.Tx, logger *slog.Logger, film *catalogue.SyncFilm) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "insertOrUpdate", trace.WithAttributes(attribute.String("film.uuid", film.UUID)))
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
+	m, ok, err := identity.ByUUID(ctx, tx, film.UUID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return insert(ctx, tx, film)
+	}
 	var id int
-	err := dbConn.DB().QueryRowContext(ctx, getFilmByUUIDSQL, film.UUID).Scan(&id)
+	var title string
+	var year sql.NullInt64
+	var lastUpdate time.Time
+	var syncOrigin, syncHash sql.NullString
+	err = tx.QueryRowContext(ctx, getFilmByIDSQL, m.LegacyID).Scan(&id, &title, &year, &lastUpdate, &syncOrigin, &syncHash)
 	switch {
 	case err == sql.ErrNoRows:
-		return insert(film)
+		// the legacy film was deleted outside of the sync, which its mapping outlived, so it is not brought back
+		logger.Warn("the film was deleted from the legacy DB", "film_uuid", film.UUID, "external_id", m.LegacyID)
+		return nil
 	case err != nil:
 		return fmt.Errorf("an error occured while searching: %w", err)
-	default:
-		return update(film)
+	case origin.Hash(title, int(year.Int64)) == film.Hash:
+		suppressEcho(logger, film)
+		return nil
 	}
+	// the legacy row was last changed by the synchronizer itself only while it still holds what was synced to it
+	local := conflict.Version{Origin: origin.Legacy, Title: title, Year: int(year.Int64), LastUpdate: lastUpdate}
+	if syncOrigin.String == origin.Catalogue && syncHash.String == origin.Hash(title, int(year.Int64)) {
+		local.Origin = origin.Catalogue
+	}
+	incoming := conflict.Version{Origin: origin.Catalogue, Title: film.Title, Year: film.Year, LastUpdate: film.UpdatedAt}
+	// the conflicts are recorded in the catalogue DB, so outside of the transaction of the legacy DB
+	resolved, apply, err := conflictHandler.Handle(ctx, nil, film.UUID, id, local, incoming)
+	if err != nil || !apply {
+		return err
+	}
+	film.Title = resolved.Title
+	film.Year = resolved.Year
+	film.Hash = origin.Hash(film.Title, film.Year)
+	return update(ctx, tx, id, film)
 }
 
-func insert(film *catalogue.Film) error {
-	ctx, cancel := dbConn.CreateContext(context.TODO())
-	defer cancel()
+func insert(ctx context.Context, tx *sql.Tx, film *catalogue.SyncFilm) error {
 	film.LastUpdate = time.Now()
-	res, err := dbConn.DB().ExecContext(ctx, insertFilmSQL, film.UUID, film.Title, film.Year, film.LastUpdate, film.UUID)
+	res, err := tx.ExecContext(ctx, insertFilmSQL, film.UUID, film.Title, film.Year, film.LastUpdate, origin.Catalogue, film.Hash, film.UUID)
 	if err != nil {
 		return fmt.Errorf("an error occured while inserting: %w", err)
 	}
@@ -80,13 +266,15 @@ func insert(film *catalogue.Film) error {
 	if rows != 1 {
 		return fmt.Errorf("the film with UUID %s was not inserted", film.UUID)
 	}
-	return nil
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("an error occured while inserting: %w", err)
+	}
+	return identity.Map(ctx, tx, identity.Mapping{UUID: film.UUID, LegacyID: int(id)})
 }
 
-func update(film *catalogue.Film) error {
-	ctx, cancel := dbConn.CreateContext(context.TODO())
-	defer cancel()
-	res, err := dbConn.DB().ExecContext(ctx, updateFilmSQL, film.Title, film.Year, film.UUID)
+func update(ctx context.Context, tx *sql.Tx, id int, film *catalogue.SyncFilm) error {
+	res, err := tx.ExecContext(ctx, updateFilmSQL, film.Title, film.Year, origin.Catalogue, film.Hash, id)
 	if err != nil {
 		return fmt.Errorf("an error occured while updating: %w", err)
 	}
@@ -100,40 +288,116 @@ func update(film *catalogue.Film) error {
 	return nil
 }
 
+// deleteFilm handles a catalogue tombstone. Films still referenced by the inventory are only flagged as deleted,
+// since removing them would break the rental history, otherwise the film and its actors and categories are removed,
+// along with its mapping. Films never mapped to the legacy DB are ignored.
+func deleteFilm(ctx context.Context, tx *sql.Tx, filmUUID string) error {
+	if filmUUID == "" {
+		return fmt.Errorf("a tombstone without key was given")
+	}
+	m, ok, err := identity.ByUUID(ctx, tx, filmUUID)
+	if err != nil || !ok {
+		return err
+	}
+	var id int
+	err = tx.QueryRowContext(ctx, getFilmIDForDeleteSQL, m.LegacyID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return identity.Unmap(ctx, tx, m)
+	}
+	if err != nil {
+		return fmt.Errorf("an error occured while searching: %w", err)
+	}
+	var inventory int
+	if err = tx.QueryRowContext(ctx, countFilmInventorySQL, id).Scan(&inventory); err != nil {
+		return fmt.Errorf("an error occured while searching the inventory: %w", err)
+	}
+	if inventory > 0 {
+		if _, err = tx.ExecContext(ctx, flagFilmAsDeletedSQL, time.Now(), id); err != nil {
+			return fmt.Errorf("an error occured while flagging as deleted: %w", err)
+		}
+		return nil
+	}
+	for _, query := range []string{deleteFilmActorsSQL, deleteFilmCategoriesSQL, deleteFilmSQL} {
+		if _, err = tx.ExecContext(ctx, query, id); err != nil {
+			return fmt.Errorf("an error occured while deleting: %w", err)
+		}
+	}
+	return identity.Unmap(ctx, tx, m)
+}
+
 func main() {
 
 	flag.Parse()
 	config := loadConfigurations()
+	logger = createLogger(config.App())
+	shutdownTracing := setupTracing(config.Tracing())
 	dbConn = createDBConnection(config.DB())
+	conflictHandler = createConflictHandler(config.Conflict())
 
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	kafkaClient := kafka.NewClient(config.Kafka(), "catalogue")
-
-	ctx := context.Background()
+	kafkaClient := createKafkaClient(config.Kafka(), "catalogue")
 
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	pruned := make(chan struct{})
 	go func() {
-
-		for {
-			err := kafkaClient.Read(ctx, readFilm)
-			if err != nil {
-				log.Println(err)
-			}
+		defer close(pruned)
+		if *dedupRetention > 0 {
+			dedup.RunPruner(consumerCtx, dbConn, *dedupRetention, *dedupPruneInterval, logger)
+		}
+	}()
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		if err := kafkaClient.Consume(consumerCtx, readFilm); err != nil && err != context.Canceled {
+			logger.Error("the consumer stopped", "error", err)
 		}
-
 	}()
 
-	log.Println("legacydb consumer started")
+	checker := createHealthChecker(config.Kafka(), kafkaClient)
+	metricsSrv := metrics.Serve(config.App().Port(), map[string]http.Handler{
+		"/livez":  checker.Liveness(),
+		"/readyz": checker.Readiness(),
+	})
 
-	<-exit
-	log.Println("server stopped")
+	logger.Info("legacydb consumer started")
 
-	_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer func() {
-		kafkaClient.Close()
-		cancel()
-	}()
+	// a consumer that stops on its own, which only happens on an unexpected error, stops the synchronizer
+	failed := false
+	select {
+	case <-exit:
+		logger.Info("server stopped")
+	case <-consumed:
+		failed = true
+	}
+
+	stopConsumer()
+	drained := true
+	select {
+	case <-consumed:
+	case <-time.After(config.App().DrainTimeout()):
+		drained = false
+		logger.Error("the messages being processed were not drained", "drain_timeout", config.App().DrainTimeout())
+	}
+	<-pruned
 
-	log.Println("consumer shutdown successfully")
+	if err := metricsSrv.Close(); err != nil {
+		logger.Error("could not close the metrics server", "error", err)
+	}
+	kafkaClient.Close()
+	if conflictConn != nil {
+		conflictConn.Close()
+	}
+	dbConn.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.App().ShutdownTimeout())
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("could not flush the traces", "error", err)
+	}
+	cancel()
+
+	if !drained || failed {
+		os.Exit(1)
+	}
+	logger.Info("consumer shutdown successfully")
 }
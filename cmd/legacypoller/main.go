@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/health"
+	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/legacy"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage: legacypoller [flags]
+
+Polls the film table of the legacy DB (db.dsn) as the connector does in its timestamp+incrementing mode, publishing
+the films changed since the last poll onto the topic the connector publishes to (kafka.topic). The watermark, the last
+update and the ID of the last published film, is saved after every published batch, so a restarted poller resumes
+right after the last published film.
+
+Flags:
+`
+
+const watermarkName = "film"
+
+const getCurrentTimestampSQL = "select current_timestamp()"
+const getWatermarkSQL = "select last_update, film_id from poller_watermarks where name = ?"
+const saveWatermarkSQL = "insert into poller_watermarks (name, last_update, film_id) values (?, ?, ?) on duplicate key update last_update = values(last_update), film_id = values(film_id)"
+
+// getChangedFilmsSQL reads the films changed after the watermark, ordered as the connector does. Films changed within
+// the current second are left for the next poll, since more films may still be changed within it.
+const getChangedFilmsSQL = "select film_id, title, release_year, last_update, uuid, deleted_at, sync_origin, sync_hash from film " +
+	"where last_update < ? and ((last_update = ? and film_id > ?) or last_update > ?) order by last_update, film_id limit ?"
+
+var configPath = flag.String("config", "", "Config file path")
+var interval = flag.Duration("interval", time.Second, "Interval between polls")
+var batchSize = flag.Int("batch-size", 100, "Maximum number of films read and published at once")
+var delay = flag.Duration("delay", 0, "How long a change is left unpublished, so the transactions committed late are not skipped")
+var fromNow = flag.Bool("from-now", false, "Without a saved watermark, publish only the films changed from now on instead of every film")
+var stallTimeout = flag.Duration("stall-timeout", 2*time.Minute, "How long the poller may go without a successful poll before it is considered stuck")
+
+var dbConn database.Connection
+var logger *slog.Logger
+var writer kafka.WriteCloser
+
+// polledAt is the time of the last successful poll, as Unix nanoseconds.
+var polledAt atomic.Int64
+
+// watermark is the last update and the ID of the last film published.
+type watermark struct {
+	LastUpdate time.Time
+	FilmID     int
+}
+
+func loadConfigurations() configs.Configurer {
+	config, err := configs.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+func createLogger(config configs.AppConfigurer) *slog.Logger {
+	logger, err := logging.New(config.LogLevel())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return logger
+}
+
+func createDBConnection(config configs.DBConfigurer) database.Connection {
+	conn, err := database.NewConnection(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn
+}
+
+func createKafkaWriter(config configs.KafkaConfigurer) kafka.WriteCloser {
+	writer, err := kafka.NewWriter(config, config.Topic(), kafka.WithLogger(logger))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return writer
+}
+
+// createHealthChecker creates the probes of the poller, which is alive while it keeps polling, and ready while the
+// legacy DB is reachable.
+func createHealthChecker() *health.Checker {
+	checker := health.NewChecker()
+	checker.AddLiveness("poller", func(ctx context.Context) error {
+		if since := time.Since(time.Unix(0, polledAt.Load())); since > *stallTimeout {
+			return fmt.Errorf("no poll succeeded for %s", since.Round(time.Second))
+		}
+		return nil
+	})
+	checker.AddReadiness("db", dbConn.Ping)
+	return checker
+}
+
+// loadWatermark loads the watermark saved by the last run. Without one, every film is published, as the connector
+// does, unless the poller starts from now.
+func loadWatermark(ctx context.Context) (watermark, error) {
+	ctx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	w := watermark{}
+	err := dbConn.DB().QueryRowContext(ctx, getWatermarkSQL, watermarkName).Scan(&w.LastUpdate, &w.FilmID)
+	if err == nil {
+		return w, nil
+	}
+	if err != sql.ErrNoRows {
+		return watermark{}, fmt.Errorf("an error occured while loading the watermark: %w", err)
+	}
+	if !*fromNow {
+		return watermark{LastUpdate: time.Unix(0, 0)}, nil
+	}
+	if err = dbConn.DB().QueryRowContext(ctx, getCurrentTimestampSQL).Scan(&w.LastUpdate); err != nil {
+		return watermark{}, fmt.Errorf("an error occured while reading the current timestamp: %w", err)
+	}
+	return w, nil
+}
+
+func saveWatermark(ctx context.Context, w watermark) error {
+	ctx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	if _, err := dbConn.DB().ExecContext(ctx, saveWatermarkSQL, watermarkName, w.LastUpdate, w.FilmID); err != nil {
+		return fmt.Errorf("an error occured while saving the watermark: %w", err)
+	}
+	return nil
+}
+
+// readChangedFilms reads the next batch of films changed after the watermark and before the given time.
+func readChangedFilms(ctx context.Context, w watermark, until time.Time) ([]*legacy.Film, error) {
+	ctx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	rows, err := dbConn.DB().QueryContext(ctx, getChangedFilmsSQL, until, w.LastUpdate, w.FilmID, w.LastUpdate, *batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while searching the changed films: %w", err)
+	}
+	defer rows.Close()
+	films := make([]*legacy.Film, 0, *batchSize)
+	for rows.Next() {
+		film := &legacy.Film{}
+		var year sql.NullInt64
+		var filmUUID, syncOrigin, syncHash sql.NullString
+		var deletedAt sql.NullTime
+		if err = rows.Scan(&film.FilmID, &film.Title, &year, &film.LastUpdate.Time, &filmUUID, &deletedAt, &syncOrigin, &syncHash); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the changed films: %w", err)
+		}
+		film.ReleaseYear = legacy.Year(year.Int64)
+		film.UUID = filmUUID.String
+		film.SyncOrigin = syncOrigin.String
+		film.SyncHash = syncHash.String
+		if deletedAt.Valid {
+			film.DeletedAt = &legacy.Timestamp{Time: deletedAt.Time}
+		}
+		films = append(films, film)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("an error occured while reading the changed films: %w", err)
+	}
+	return films, nil
+}
+
+// poll publishes the films changed after the watermark, a batch at a time, moving the watermark past every published
+// batch. Films changed within the delay are left for a later poll.
+func poll(ctx context.Context, w *watermark) error {
+	queryCtx, cancel := dbConn.CreateContext(ctx)
+	defer cancel()
+	var now time.Time
+	if err := dbConn.DB().QueryRowContext(queryCtx, getCurrentTimestampSQL).Scan(&now); err != nil {
+		return fmt.Errorf("an error occured while reading the current timestamp: %w", err)
+	}
+	until := now.Add(-*delay)
+	for ctx.Err() == nil {
+		films, err := readChangedFilms(ctx, *w, until)
+		if err != nil {
+			return err
+		}
+		if len(films) == 0 {
+			return nil
+		}
+		msgs := make([]kafka.Message, 0, len(films))
+		for _, film := range films {
+			msg, err := legacy.Encode(film)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		// a batch read is published and saved even when the poller is being stopped, so it is not published twice
+		if err = writer.WriteMessages(context.WithoutCancel(ctx), msgs...); err != nil {
+			return fmt.Errorf("an error occured while publishing the changed films: %w", err)
+		}
+		last := films[len(films)-1]
+		next := watermark{LastUpdate: last.LastUpdate.Time, FilmID: last.FilmID}
+		if err = saveWatermark(context.WithoutCancel(ctx), next); err != nil {
+			return err
+		}
+		*w = next
+		logger.Info("changed films published", "count", len(films), "last_update", next.LastUpdate, "film_id", next.FilmID)
+		if len(films) < *batchSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+// run polls the legacy DB every interval until the context is cancelled. A failed poll is retried by the next one.
+func run(ctx context.Context) error {
+	w, err := loadWatermark(ctx)
+	if err != nil {
+		return err
+	}
+	polledAt.Store(time.Now().UnixNano())
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err = poll(ctx, &w); err != nil && ctx.Err() == nil {
+			logger.Error("the poll failed", "error", err)
+		} else if err == nil {
+			polledAt.Store(time.Now().UnixNano())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *batchSize <= 0 {
+		log.Fatal("the batch size must be positive")
+	}
+	config := loadConfigurations()
+	logger = createLogger(config.App())
+	dbConn = createDBConnection(config.DB())
+	writer = createKafkaWriter(config.Kafka())
+
+	checker := createHealthChecker()
+	metricsSrv := metrics.Serve(config.App().Port(), map[string]http.Handler{
+		"/livez":  checker.Liveness(),
+		"/readyz": checker.Readiness(),
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("legacy poller started", "topic", config.Kafka().Topic(), "interval", *interval)
+	err := run(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error("the legacy poller stopped", "error", err)
+	}
+
+	if err := metricsSrv.Close(); err != nil {
+		logger.Error("could not close the metrics server", "error", err)
+	}
+	writer.Close()
+	dbConn.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+	logger.Info("legacy poller shutdown successfully")
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/catalogue"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/event"
+	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/legacy"
+	"github.com/diegohordi/go-kafka/internal/origin"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: reconcile [flags]
+
+Compares the films of the catalogue DB (db.dsn) with the films of the legacy DB (legacy.dsn) on their title and year,
+and reports the missing films and the mismatching fields. Films are compared by chunks of legacy film IDs, whose
+checksums are compared first, so only the rows of the chunks that differ are read.
+
+With -heal, every drift is repaired by a corrective event written onto the sync topics, so the synchronizers apply it
+as any other change.
+
+Flags:
+`
+
+// Kinds of drift.
+const (
+	MissingInCatalogue = "missing_in_catalogue"
+	MissingInLegacy    = "missing_in_legacy"
+	DeletedInLegacy    = "deleted_in_legacy"
+	Mismatch           = "mismatch"
+)
+
+// Sides a mismatch is healed in favour of.
+const (
+	PreferNewest    = "newest"
+	PreferLegacy    = origin.Legacy
+	PreferCatalogue = origin.Catalogue
+)
+
+// catalogueChunkSQL reads the catalogue films of a chunk of legacy film IDs by their identity mapping, or by their
+// external ID for the ones synced before the mapping existed, since the films created through the API are only mapped.
+// The range of the chunk is given once for each, so both are filtered on indexed columns.
+const catalogueChunkSQL = "(select f.id, fi.legacy_film_id, f.uuid, f.title, f.year, f.last_update from film_identities fi " +
+	"join films f on f.uuid = fi.uuid where fi.legacy_film_id >= ? and fi.legacy_film_id < ? " +
+	"union all select f.id, f.external_id, f.uuid, f.title, f.year, f.last_update from films f " +
+	"left join film_identities fi on fi.uuid = f.uuid where f.external_id >= ? and f.external_id < ? and fi.uuid is null) as films"
+
+const getMaxLegacyIDSQL = "select coalesce(max(film_id), 0) from film"
+const getMaxCatalogueIDSQL = "select greatest((select coalesce(max(legacy_film_id), 0) from film_identities), (select coalesce(max(external_id), 0) from films))"
+const legacyChecksumSQL = "select count(film_id), coalesce(bit_xor(crc32(concat_ws('#', film_id, title, coalesce(release_year, '')))), 0) from film where film_id >= ? and film_id < ? and deleted_at is null"
+const catalogueChecksumSQL = "select count(id), coalesce(bit_xor(crc32(concat_ws('#', legacy_film_id, title, coalesce(year, '')))), 0) from " + catalogueChunkSQL
+const getLegacyFilmsSQL = "select film_id, uuid, title, release_year, last_update, deleted_at from film where film_id >= ? and film_id < ?"
+const getCatalogueFilmsSQL = "select legacy_film_id, uuid, title, year, last_update from " + catalogueChunkSQL
+const getUnsyncedFilmsSQL = "select f.uuid, f.title, f.year, f.last_update from films f left join film_identities fi on fi.uuid = f.uuid " +
+	"where f.external_id is null and fi.uuid is null"
+
+var configPath = flag.String("config", "", "Config file path")
+var format = flag.String("format", "json", "Report format, json or csv")
+var output = flag.String("output", "", "Report file, instead of the standard output")
+var chunkSize = flag.Int("chunk-size", 500, "Number of legacy film IDs compared at once")
+var grace = flag.Duration("grace", time.Minute, "Films changed on either side within this duration are not reported, since their sync may be in flight")
+var heal = flag.Bool("heal", false, "Repair the drifts by writing corrective events onto the sync topics")
+var prefer = flag.String("prefer", PreferNewest, "Side a mismatch is healed in favour of: newest, legacy or catalogue")
+var catalogueTopic = flag.String("catalogue-topic", "catalogue", "Topic of the catalogue events, consumed by the legacy DB synchronizer")
+var legacyTopic = flag.String("legacy-topic", "p_film", "Topic of the legacy DB connector, consumed by the catalogue synchronizer")
+
+var catalogueConn database.Connection
+var legacyConn database.Connection
+
+// side is the version of a film in one of the databases.
+type side struct {
+	UUID       string     `json:"uuid,omitempty"`
+	Title      string     `json:"title"`
+	Year       int        `json:"year"`
+	LastUpdate time.Time  `json:"last_update"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+}
+
+// drift is a film that differs between the databases. HealedIn is the database the corrective event was written to.
+type drift struct {
+	Kind      string   `json:"kind"`
+	LegacyID  int      `json:"legacy_film_id,omitempty"`
+	UUID      string   `json:"uuid,omitempty"`
+	Fields    []string `json:"fields,omitempty"`
+	Legacy    *side    `json:"legacy,omitempty"`
+	Catalogue *side    `json:"catalogue,omitempty"`
+	HealedIn  string   `json:"healed_in,omitempty"`
+}
+
+// report is the outcome of a reconciliation.
+type report struct {
+	StartedAt        time.Time `json:"started_at"`
+	FinishedAt       time.Time `json:"finished_at"`
+	Chunks           int       `json:"chunks"`
+	MismatchedChunks int       `json:"mismatched_chunks"`
+	Drifts           []drift   `json:"drifts"`
+}
+
+// checksum sums up the films of a chunk.
+type checksum struct {
+	count int
+	sum   uint64
+}
+
+// healer writes the corrective events of the drifts of a chunk.
+type healer struct {
+	legacyWriter    kafka.WriteCloser
+	catalogueWriter kafka.WriteCloser
+	legacyMsgs      []kafka.Message
+	catalogueMsgs   []kafka.Message
+}
+
+func loadConfigurations() configs.Configurer {
+	// the topics healed through are given by the flags
+	opts := []configs.LoadOption{configs.WithLegacyDB(), configs.WithoutTopic()}
+	if !*heal {
+		opts = append(opts, configs.WithoutKafka())
+	}
+	config, err := configs.Load(*configPath, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+func createDBConnection(config configs.DBConfigurer) database.Connection {
+	conn, err := database.NewConnection(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn
+}
+
+func createWriter(config configs.KafkaConfigurer, topic string) kafka.WriteCloser {
+	writer, err := kafka.NewWriter(config, topic)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return writer
+}
+
+// maxID returns the highest legacy film ID known by either database.
+func maxID(ctx context.Context) (int, error) {
+	var legacyMax, catalogueMax int
+	legacyCtx, cancel := legacyConn.CreateContext(ctx)
+	defer cancel()
+	if err := legacyConn.DB().QueryRowContext(legacyCtx, getMaxLegacyIDSQL).Scan(&legacyMax); err != nil {
+		return 0, fmt.Errorf("an error occured while searching the legacy films: %w", err)
+	}
+	catalogueCtx, cancel := catalogueConn.CreateContext(ctx)
+	defer cancel()
+	if err := catalogueConn.DB().QueryRowContext(catalogueCtx, getMaxCatalogueIDSQL).Scan(&catalogueMax); err != nil {
+		return 0, fmt.Errorf("an error occured while searching the catalogue films: %w", err)
+	}
+	if catalogueMax > legacyMax {
+		return catalogueMax, nil
+	}
+	return legacyMax, nil
+}
+
+// chunkArgs returns the arguments of the given chunk query, whose every range of legacy film IDs is given by a pair of
+// placeholders.
+func chunkArgs(query string, from, to int) []interface{} {
+	args := make([]interface{}, 0, 4)
+	for i := 0; i < strings.Count(query, "?"); i += 2 {
+		args = append(args, from, to)
+	}
+	return args
+}
+
+// sum returns the checksum of the films of the given chunk in the given database, computed by the database itself,
+// so the rows of a chunk are only read when both checksums differ.
+func sum(ctx context.Context, conn database.Connection, query string, from, to int) (checksum, error) {
+	ctx, cancel := conn.CreateContext(ctx)
+	defer cancel()
+	c := checksum{}
+	if err := conn.DB().QueryRowContext(ctx, query, chunkArgs(query, from, to)...).Scan(&c.count, &c.sum); err != nil {
+		return checksum{}, fmt.Errorf("an error occured while summing the films from %d to %d: %w", from, to, err)
+	}
+	return c, nil
+}
+
+// readLegacyFilms reads the legacy films of the given chunk, including the ones flagged as deleted, by their ID.
+func readLegacyFilms(ctx context.Context, from, to int) (map[int]*side, error) {
+	ctx, cancel := legacyConn.CreateContext(ctx)
+	defer cancel()
+	rows, err := legacyConn.DB().QueryContext(ctx, getLegacyFilmsSQL, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while reading the legacy films: %w", err)
+	}
+	defer rows.Close()
+	films := make(map[int]*side)
+	for rows.Next() {
+		var id int
+		var filmUUID sql.NullString
+		var year sql.NullInt64
+		var deletedAt sql.NullTime
+		film := &side{}
+		if err = rows.Scan(&id, &filmUUID, &film.Title, &year, &film.LastUpdate, &deletedAt); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the legacy films: %w", err)
+		}
+		film.UUID = filmUUID.String
+		film.Year = int(year.Int64)
+		if deletedAt.Valid {
+			film.DeletedAt = &deletedAt.Time
+		}
+		films[id] = film
+	}
+	return films, rows.Err()
+}
+
+// readCatalogueFilms reads the catalogue films of the given chunk, by their legacy film ID.
+func readCatalogueFilms(ctx context.Context, from, to int) (map[int]*side, error) {
+	ctx, cancel := catalogueConn.CreateContext(ctx)
+	defer cancel()
+	rows, err := catalogueConn.DB().QueryContext(ctx, getCatalogueFilmsSQL, chunkArgs(getCatalogueFilmsSQL, from, to)...)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while reading the catalogue films: %w", err)
+	}
+	defer rows.Close()
+	films := make(map[int]*side)
+	for rows.Next() {
+		var id int
+		var filmUUID sql.NullString
+		var year sql.NullInt64
+		film := &side{}
+		if err = rows.Scan(&id, &filmUUID, &film.Title, &year, &film.LastUpdate); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the catalogue films: %w", err)
+		}
+		film.UUID = filmUUID.String
+		film.Year = int(year.Int64)
+		films[id] = film
+	}
+	return films, rows.Err()
+}
+
+// compare returns the drift of the given film, if any. Either side may be missing.
+func compare(id int, legacyFilm, catalogueFilm *side) (drift, bool) {
+	d := drift{LegacyID: id, Legacy: legacyFilm, Catalogue: catalogueFilm}
+	switch {
+	case catalogueFilm == nil && (legacyFilm == nil || legacyFilm.DeletedAt != nil):
+		return drift{}, false
+	case catalogueFilm == nil:
+		d.Kind = MissingInCatalogue
+		d.UUID = legacyFilm.UUID
+		return d, true
+	case legacyFilm == nil || legacyFilm.DeletedAt != nil:
+		d.Kind = DeletedInLegacy
+		d.UUID = catalogueFilm.UUID
+		return d, true
+	}
+	d.UUID = catalogueFilm.UUID
+	if legacyFilm.Title != catalogueFilm.Title {
+		d.Fields = append(d.Fields, "title")
+	}
+	if legacyFilm.Year != catalogueFilm.Year {
+		d.Fields = append(d.Fields, "year")
+	}
+	if len(d.Fields) == 0 {
+		return drift{}, false
+	}
+	d.Kind = Mismatch
+	return d, true
+}
+
+// recent tells whether either side of the given drift changed within the grace period.
+func (d drift) recent(since time.Time) bool {
+	return (d.Legacy != nil && d.Legacy.LastUpdate.After(since)) || (d.Catalogue != nil && d.Catalogue.LastUpdate.After(since))
+}
+
+// reconcileChunk returns the drifts of the films of the given chunk, telling whether its checksums differed.
+func reconcileChunk(ctx context.Context, from, to int, since time.Time) ([]drift, bool, error) {
+	legacySum, err := sum(ctx, legacyConn, legacyChecksumSQL, from, to)
+	if err != nil {
+		return nil, false, err
+	}
+	catalogueSum, err := sum(ctx, catalogueConn, catalogueChecksumSQL, from, to)
+	if err != nil {
+		return nil, false, err
+	}
+	if legacySum == catalogueSum {
+		return nil, false, nil
+	}
+	legacyFilms, err := readLegacyFilms(ctx, from, to)
+	if err != nil {
+		return nil, true, err
+	}
+	catalogueFilms, err := readCatalogueFilms(ctx, from, to)
+	if err != nil {
+		return nil, true, err
+	}
+	var drifts []drift
+	for id := from; id < to; id++ {
+		d, ok := compare(id, legacyFilms[id], catalogueFilms[id])
+		if ok && !d.recent(since) {
+			drifts = append(drifts, d)
+		}
+	}
+	return drifts, true, nil
+}
+
+// unsyncedDrifts returns the catalogue films that were never synced to the legacy DB, since they are neither mapped to
+// a legacy film nor have an external ID.
+func unsyncedDrifts(ctx context.Context, since time.Time) ([]drift, error) {
+	ctx, cancel := catalogueConn.CreateContext(ctx)
+	defer cancel()
+	rows, err := catalogueConn.DB().QueryContext(ctx, getUnsyncedFilmsSQL)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while reading the unsynced films: %w", err)
+	}
+	defer rows.Close()
+	var drifts []drift
+	for rows.Next() {
+		var filmUUID sql.NullString
+		var year sql.NullInt64
+		film := &side{}
+		if err = rows.Scan(&filmUUID, &film.Title, &year, &film.LastUpdate); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the unsynced films: %w", err)
+		}
+		film.UUID = filmUUID.String
+		film.Year = int(year.Int64)
+		d := drift{Kind: MissingInLegacy, UUID: film.UUID, Catalogue: film}
+		if !d.recent(since) {
+			drifts = append(drifts, d)
+		}
+	}
+	return drifts, rows.Err()
+}
+
+// healedIn returns the database the given drift is repaired in.
+func healedIn(d drift) string {
+	switch d.Kind {
+	case MissingInCatalogue, DeletedInLegacy:
+		return origin.Catalogue
+	case MissingInLegacy:
+		return origin.Legacy
+	}
+	switch *prefer {
+	case PreferLegacy:
+		return origin.Catalogue
+	case PreferCatalogue:
+		return origin.Legacy
+	}
+	if d.Catalogue.LastUpdate.After(d.Legacy.LastUpdate) {
+		return origin.Legacy
+	}
+	return origin.Catalogue
+}
+
+// add queues the corrective event of the given drift: a connector message carrying the legacy film, when the
+// catalogue is repaired, or a catalogue event carrying the catalogue film otherwise. Connector messages are marked as
+// changed in the legacy DB, so they are not taken as echoes. Both are marked as repairs, so the synchronizers apply
+// them over the local rows however old they are, instead of resolving them as conflicts.
+func (h *healer) add(d drift) error {
+	if healedIn(d) == origin.Legacy {
+		film := catalogue.Film{UUID: d.Catalogue.UUID, Title: d.Catalogue.Title, Year: d.Catalogue.Year}
+		eventType := event.FilmUpdated
+		if d.Kind == MissingInLegacy {
+			eventType = event.FilmCreated
+		}
+		e, err := event.New(eventType, origin.Catalogue, catalogue.SyncFilm{
+			Film:      film,
+			Origin:    origin.Catalogue,
+			Hash:      origin.Hash(film.Title, film.Year),
+			UpdatedAt: d.Catalogue.LastUpdate,
+		})
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("an error occured while marshalling the event of the film %s: %w", film.UUID, err)
+		}
+		h.catalogueMsgs = append(h.catalogueMsgs, kafka.Message{Key: []byte(film.UUID), Value: value, Headers: repairHeaders()})
+		return nil
+	}
+	film := &legacy.Film{
+		FilmID:     d.LegacyID,
+		UUID:       d.UUID,
+		SyncOrigin: origin.Legacy,
+		LastUpdate: legacy.Timestamp{Time: time.Now()},
+	}
+	if d.Legacy != nil {
+		film.Title = d.Legacy.Title
+		film.ReleaseYear = legacy.Year(d.Legacy.Year)
+		film.LastUpdate = legacy.Timestamp{Time: d.Legacy.LastUpdate}
+	}
+	if d.Kind == DeletedInLegacy {
+		film.DeletedAt = &legacy.Timestamp{Time: time.Now()}
+		if d.Legacy != nil && d.Legacy.DeletedAt != nil {
+			film.DeletedAt.Time = *d.Legacy.DeletedAt
+		}
+	}
+	film.SyncHash = film.Hash()
+	msg, err := legacy.Encode(film)
+	if err != nil {
+		return err
+	}
+	msg.Headers = repairHeaders()
+	h.legacyMsgs = append(h.legacyMsgs, msg)
+	return nil
+}
+
+func repairHeaders() map[string]string {
+	return map[string]string{kafka.HeaderRepair: "true"}
+}
+
+// flush writes the queued corrective events.
+func (h *healer) flush(ctx context.Context) error {
+	if len(h.catalogueMsgs) > 0 {
+		if err := h.catalogueWriter.WriteMessages(ctx, h.catalogueMsgs...); err != nil {
+			return fmt.Errorf("an error occured while writing the catalogue events: %w", err)
+		}
+		h.catalogueMsgs = nil
+	}
+	if len(h.legacyMsgs) > 0 {
+		if err := h.legacyWriter.WriteMessages(ctx, h.legacyMsgs...); err != nil {
+			return fmt.Errorf("an error occured while writing the legacy messages: %w", err)
+		}
+		h.legacyMsgs = nil
+	}
+	return nil
+}
+
+// reconcile compares both databases chunk by chunk, healing the drifts of each chunk once it is compared, when a
+// healer is given.
+func reconcile(ctx context.Context, h *healer) (*report, error) {
+	r := &report{StartedAt: time.Now(), Drifts: []drift{}}
+	since := r.StartedAt.Add(-*grace)
+	last, err := maxID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for from := 1; from <= last; from += *chunkSize {
+		drifts, mismatched, err := reconcileChunk(ctx, from, from+*chunkSize, since)
+		if err != nil {
+			return nil, err
+		}
+		r.Chunks++
+		if mismatched {
+			r.MismatchedChunks++
+		}
+		if err = healDrifts(ctx, h, drifts); err != nil {
+			return nil, err
+		}
+		r.Drifts = append(r.Drifts, drifts...)
+	}
+	drifts, err := unsyncedDrifts(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	if err = healDrifts(ctx, h, drifts); err != nil {
+		return nil, err
+	}
+	r.Drifts = append(r.Drifts, drifts...)
+	r.FinishedAt = time.Now()
+	return r, nil
+}
+
+// healDrifts writes the corrective events of the given drifts, when a healer is given.
+func healDrifts(ctx context.Context, h *healer, drifts []drift) error {
+	if h == nil {
+		return nil
+	}
+	for _, d := range drifts {
+		if err := h.add(d); err != nil {
+			return err
+		}
+	}
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+	// the drifts are only reported as healed once their corrective events are written
+	for i := range drifts {
+		drifts[i].HealedIn = healedIn(drifts[i])
+	}
+	return nil
+}
+
+// writeCSV writes a line per drift, along with both sides of the film.
+func writeCSV(w io.Writer, r *report) error {
+	writer := csv.NewWriter(w)
+	header := []string{"kind", "legacy_film_id", "uuid", "fields", "legacy_title", "legacy_year", "legacy_last_update",
+		"catalogue_title", "catalogue_year", "catalogue_last_update", "healed_in"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, d := range r.Drifts {
+		record := []string{d.Kind, "", d.UUID, "", "", "", "", "", "", "", d.HealedIn}
+		if d.LegacyID != 0 {
+			record[1] = strconv.Itoa(d.LegacyID)
+		}
+		for i, field := range d.Fields {
+			if i > 0 {
+				record[3] += " "
+			}
+			record[3] += field
+		}
+		if d.Legacy != nil {
+			record[4], record[5], record[6] = d.Legacy.Title, strconv.Itoa(d.Legacy.Year), d.Legacy.LastUpdate.Format(time.RFC3339)
+		}
+		if d.Catalogue != nil {
+			record[7], record[8], record[9] = d.Catalogue.Title, strconv.Itoa(d.Catalogue.Year), d.Catalogue.LastUpdate.Format(time.RFC3339)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeReport(r *report) error {
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("an error occured while creating the report: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == "csv" {
+		return writeCSV(w, r)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *format != "json" && *format != "csv" {
+		log.Fatalf("unknown report format %q", *format)
+	}
+	if *prefer != PreferNewest && *prefer != PreferLegacy && *prefer != PreferCatalogue {
+		log.Fatalf("unknown preferred side %q", *prefer)
+	}
+	if *chunkSize < 1 {
+		log.Fatalf("the chunk size must be at least 1, got %d", *chunkSize)
+	}
+
+	config := loadConfigurations()
+	catalogueConn = createDBConnection(config.DB())
+	defer catalogueConn.Close()
+	legacyConn = createDBConnection(config.Legacy().DB())
+	defer legacyConn.Close()
+
+	var h *healer
+	if *heal {
+		h = &healer{
+			legacyWriter:    createWriter(config.Kafka(), *legacyTopic),
+			catalogueWriter: createWriter(config.Kafka(), *catalogueTopic),
+		}
+		defer h.legacyWriter.Close()
+		defer h.catalogueWriter.Close()
+	}
+
+	r, err := reconcile(context.Background(), h)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = writeReport(r); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d drifts found in %d of %d chunks", len(r.Drifts), r.MismatchedChunks, r.Chunks)
+}
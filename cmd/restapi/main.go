@@ -7,13 +7,18 @@ import (
 	"github.com/diegohordi/go-kafka/internal/catalogue"
 	"github.com/diegohordi/go-kafka/internal/configs"
 	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/health"
 	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"github.com/diegohordi/go-kafka/internal/outbox"
+	"github.com/diegohordi/go-kafka/internal/tracing"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -30,6 +35,24 @@ func loadConfigurations() configs.Configurer {
 	return config
 }
 
+// createLogger creates the logger of the API with the configured level.
+func createLogger(config configs.AppConfigurer) *slog.Logger {
+	logger, err := logging.New(config.LogLevel())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return logger
+}
+
+// setupTracing sets up the tracing of the API based on the given configuration.
+func setupTracing(config configs.TracingConfigurer) tracing.ShutdownFunc {
+	shutdown, err := tracing.Setup(context.Background(), config, "restapi")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return shutdown
+}
+
 // createDBConnection creates a new database connection based on the given configuration.
 func createDBConnection(config configs.Configurer) database.Connection {
 	dbConn, err := database.NewConnection(config.DB())
@@ -39,33 +62,72 @@ func createDBConnection(config configs.Configurer) database.Connection {
 	return dbConn
 }
 
+// createKafkaClient creates a new Kafka client based on the given configuration.
+func createKafkaClient(config configs.KafkaConfigurer, groupName string, opts ...kafka.Option) kafka.Client {
+	client, err := kafka.NewClient(config, groupName, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
+
+// createHealthChecker creates the probes of the API, which is ready while its database and Kafka are reachable.
+func createHealthChecker(dbConn database.Connection, kafkaClient kafka.Client) *health.Checker {
+	checker := health.NewChecker()
+	checker.AddReadiness("db", dbConn.Ping)
+	checker.AddReadiness("kafka", kafkaClient.Ping)
+	return checker
+}
+
 func main() {
 
 	flag.Parse()
 	config := loadConfigurations()
+	logger := createLogger(config.App())
+	shutdownTracing := setupTracing(config.Tracing())
 	dbConn := createDBConnection(config)
-	logger := log.New(os.Stdout, "", log.LstdFlags)
 
 	router := chi.NewRouter()
-	router.Use(middleware.Heartbeat("/health"))
 	router.Use(middleware.RequestID)
+	router.Use(tracing.Middleware)
 	router.Use(middleware.RealIP)
-	router.Use(middleware.Logger)
+	router.Use(logging.Middleware(logger))
 	router.Use(middleware.Recoverer)
+	router.Use(metrics.Middleware)
 	router.Use(middleware.SetHeader("Content-type", "application/json"))
+	router.Method(http.MethodGet, "/metrics", metrics.Handler())
 
-	kafkaClient := kafka.NewClient(config.Kafka(), "films")
+	// the relay is only created along with the client it writes through, but the asynchronous writes of the client are
+	// completed by the relay
+	var relay *outbox.Relay
+	kafkaClient := createKafkaClient(config.Kafka(), "films", kafka.WithCompletion(func(msgs []kafka.Message, err error) {
+		relay.Complete(msgs, err)
+	}), kafka.WithLogger(logger))
 
-	catalogueService := catalogue.NewService(dbConn, kafkaClient)
+	catalogueService := catalogue.NewService(dbConn, logger)
 	catalogue.Setup(router, catalogueService)
 
+	checker := createHealthChecker(dbConn, kafkaClient)
+	router.Method(http.MethodGet, "/livez", checker.Liveness())
+	// the heartbeat answered at /health before the probes existed is kept for the probes and load balancers using it
+	router.Method(http.MethodGet, "/health", checker.Liveness())
+	router.Method(http.MethodGet, "/readyz", checker.Readiness())
+
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	relay = outbox.NewRelay(dbConn, kafkaClient, config.Kafka().WriterAsync(), logger)
+	go func() {
+		defer close(relayDone)
+		relay.Run(relayCtx)
+	}()
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", config.App().Port()),
 		Handler:      router,
-		ErrorLog:     logger,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ReadTimeout:  config.App().ReadTimeout(),
+		WriteTimeout: config.App().WriteTimeout(),
+		IdleTimeout:  config.App().IdleTimeout(),
 	}
 
 	exit := make(chan os.Signal, 1)
@@ -73,25 +135,34 @@ func main() {
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal(err)
+			logger.Error("the server stopped unexpectedly", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	log.Println(fmt.Sprint("server started listening at ", config.App().Port()))
+	logger.Info("server started listening", "port", config.App().Port())
 
 	<-exit
-	log.Println(logger, "server stopped")
+	logger.Info("server stopped")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), config.App().ShutdownTimeout())
+	// the relay is stopped before the Kafka client is closed, which flushes the buffered messages and waits for their
+	// completion, which in turn needs the DB connection to mark them as sent
 	defer func() {
-		dbConn.Close()
+		stopRelay()
+		<-relayDone
 		kafkaClient.Close()
+		dbConn.Close()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("could not flush the traces", "error", err)
+		}
 		cancel()
 	}()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		logger.Fatal(fmt.Errorf("an error occurred while server is shutting down: %w", err))
+		logger.Error("an error occurred while server is shutting down", "error", err)
+		return
 	}
 
-	log.Println("server shutdown successfully")
+	logger.Info("server shutdown successfully")
 }
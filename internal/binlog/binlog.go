@@ -0,0 +1,550 @@
+package binlog
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"time"
+)
+
+// Event types read by the stream.
+const (
+	queryEvent             = 2
+	rotateEvent            = 4
+	formatDescriptionEvent = 15
+	xidEvent               = 16
+	tableMapEvent          = 19
+	writeRowsEventV1       = 23
+	updateRowsEventV1      = 24
+	deleteRowsEventV1      = 25
+	heartbeatEvent         = 27
+	writeRowsEventV2       = 30
+	updateRowsEventV2      = 31
+	deleteRowsEventV2      = 32
+	gtidEvent              = 33
+)
+
+const eventHeaderSize = 19
+
+// Commands of the replication protocol.
+const (
+	comBinlogDump     = 0x12
+	comBinlogDumpGTID = 0x1e
+	binlogThroughGTID = 0x04
+)
+
+// Actions of the row events.
+const (
+	Insert = "insert"
+	Update = "update"
+	Delete = "delete"
+)
+
+var ErrClosed = errors.New("the binlog stream was closed")
+
+// ErrUnsupportedBinlog is returned by Open when the server does not log full row images, which is not fixed by
+// retrying.
+var ErrUnsupportedBinlog = errors.New("the binlog must be logged as full row images")
+
+// Config is the configuration of a binlog stream.
+type Config struct {
+	// DSN is the DSN of the server, as the MySQL driver takes it. The user must be granted REPLICATION SLAVE and
+	// REPLICATION CLIENT.
+	DSN string
+	// ServerID identifies the stream as a replica, so it must differ from the ID of the server and its replicas.
+	ServerID uint32
+	// HeartbeatPeriod is how often an idle server tells the stream it is alive. The stream fails when the server is
+	// silent for twice as long.
+	HeartbeatPeriod time.Duration
+	// Tables are the tables whose rows are decoded, as schema.table. The row events of the other tables are skipped
+	// without being decoded. The rows of every table are decoded when empty.
+	Tables []string
+}
+
+// Position is where the stream is in the binlog. A stream started with a GTID set is resumed from the set, and
+// otherwise from the file and position.
+type Position struct {
+	File    string
+	Pos     uint32
+	GTIDSet string
+}
+
+// RowsEvent holds the rows changed by a statement in a table. Inserts and deletes hold the image of each row, while
+// updates hold the image of each row before and after the change in turn. The values of an image are ordered as the
+// columns of the table, with nil for NULL and for the columns the image does not include.
+type RowsEvent struct {
+	Action string
+	Schema string
+	Table  string
+	Rows   [][]interface{}
+}
+
+// Event is an event of the binlog the stream knows about. Rows is only set for row events. Position is the position
+// following the event, which is safe to resume from when Commit is set, since the event ends a transaction.
+type Event struct {
+	Timestamp time.Time
+	Rows      *RowsEvent
+	Position  Position
+	Commit    bool
+}
+
+// table is a table described by a table map event.
+type table struct {
+	schema string
+	name   string
+	types  []byte
+	meta   []uint16
+}
+
+// Stream reads the events of the binlog of a server as one of its replicas.
+type Stream struct {
+	conn     *conn
+	config   Config
+	position Position
+	gtids    GTIDSet
+	gtid     string
+	gno      int64
+	checksum bool
+	tables   map[uint64]*table
+}
+
+// Open starts streaming the binlog from the given position, or from the current position of the server when the
+// given position is empty, in which case the stream is started with the executed GTID set of the server when GTIDs are
+// enabled.
+func Open(ctx context.Context, config Config, from Position) (*Stream, error) {
+	c, err := dial(ctx, config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stream{conn: c, config: config, position: from, tables: make(map[uint64]*table)}
+	if err = s.start(ctx); err != nil {
+		_ = c.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// start sets the session up and sends the dump command. The server must log full row images, since the row events
+// are only decoded, and the updates only compared, as whole rows.
+func (s *Stream) start(ctx context.Context) error {
+	row, err := s.conn.queryRow(ctx, "select @@global.binlog_format, @@global.binlog_row_image")
+	if err != nil {
+		return err
+	}
+	if row[0] != "ROW" {
+		return fmt.Errorf("%w: the binlog format is %s instead of ROW", ErrUnsupportedBinlog, row[0])
+	}
+	if row[1] != "FULL" {
+		return fmt.Errorf("%w: the binlog row image is %s instead of FULL", ErrUnsupportedBinlog, row[1])
+	}
+	if row, err = s.conn.queryRow(ctx, "select @@global.binlog_checksum"); err != nil {
+		return err
+	}
+	s.checksum = row[0] == "CRC32"
+	if err = s.conn.exec(ctx, "set @master_binlog_checksum = @@global.binlog_checksum"); err != nil {
+		return err
+	}
+	if s.config.HeartbeatPeriod > 0 {
+		if err = s.conn.exec(ctx, fmt.Sprintf("set @master_heartbeat_period = %d", s.config.HeartbeatPeriod.Nanoseconds())); err != nil {
+			return err
+		}
+	}
+	if s.position.File == "" && s.position.GTIDSet == "" {
+		if s.position, err = s.currentPosition(ctx); err != nil {
+			return err
+		}
+	}
+	if s.gtids, err = ParseGTIDSet(s.position.GTIDSet); err != nil {
+		return err
+	}
+	if err = s.conn.takeOver(); err != nil {
+		return err
+	}
+	command, err := s.dumpCommand()
+	if err != nil {
+		return err
+	}
+	return s.conn.writeCommand(command)
+}
+
+// currentPosition returns the current position of the server, along with its executed GTID set when GTIDs are
+// enabled.
+func (s *Stream) currentPosition(ctx context.Context) (Position, error) {
+	row, err := s.conn.queryRow(ctx, "show master status")
+	if err != nil {
+		// the statement was renamed by MySQL 8.2
+		if row, err = s.conn.queryRow(ctx, "show binary log status"); err != nil {
+			return Position{}, err
+		}
+	}
+	if len(row) < 2 {
+		return Position{}, fmt.Errorf("the binary log is not enabled")
+	}
+	pos, err := strconv.ParseUint(row[1], 10, 32)
+	if err != nil {
+		return Position{}, fmt.Errorf("invalid binlog position %q: %w", row[1], err)
+	}
+	position := Position{File: row[0], Pos: uint32(pos)}
+	mode, err := s.conn.queryRow(ctx, "select @@global.gtid_mode")
+	if err == nil && mode[0] == "ON" && len(row) >= 5 {
+		position.GTIDSet = row[4]
+	}
+	return position, nil
+}
+
+// dumpCommand returns the command that starts the dump from the position of the stream.
+func (s *Stream) dumpCommand() ([]byte, error) {
+	if s.position.GTIDSet != "" {
+		data, err := s.gtids.encode()
+		if err != nil {
+			return nil, err
+		}
+		command := []byte{comBinlogDumpGTID}
+		command = binary.LittleEndian.AppendUint16(command, binlogThroughGTID)
+		command = binary.LittleEndian.AppendUint32(command, s.config.ServerID)
+		command = binary.LittleEndian.AppendUint32(command, 0)
+		command = binary.LittleEndian.AppendUint64(command, 4)
+		command = binary.LittleEndian.AppendUint32(command, uint32(len(data)))
+		return append(command, data...), nil
+	}
+	pos := s.position.Pos
+	if pos < 4 {
+		pos = 4
+	}
+	command := []byte{comBinlogDump}
+	command = binary.LittleEndian.AppendUint32(command, pos)
+	command = binary.LittleEndian.AppendUint16(command, 0)
+	command = binary.LittleEndian.AppendUint32(command, s.config.ServerID)
+	return append(command, s.position.File...), nil
+}
+
+// Next returns the next event the stream knows about, waiting for it. Events of other types only move the position
+// of the stream forward.
+func (s *Stream) Next() (Event, error) {
+	for {
+		packet, err := s.conn.readPacket(2 * s.config.HeartbeatPeriod)
+		if err != nil {
+			return Event{}, err
+		}
+		if len(packet) == 0 {
+			return Event{}, fmt.Errorf("the server sent an empty packet")
+		}
+		switch packet[0] {
+		case 0xff:
+			return Event{}, serverError(packet)
+		case 0xfe:
+			if len(packet) < 9 {
+				return Event{}, ErrClosed
+			}
+		}
+		e, ok, err := s.parse(packet[1:])
+		if err != nil {
+			return Event{}, err
+		}
+		if ok {
+			return e, nil
+		}
+	}
+}
+
+// Position returns the position following the last event read.
+func (s *Stream) Position() Position {
+	return s.position
+}
+
+// Close stops the stream.
+func (s *Stream) Close() error {
+	return s.conn.close()
+}
+
+// parse parses an event, telling whether it is one the stream returns.
+func (s *Stream) parse(data []byte) (Event, bool, error) {
+	if len(data) < eventHeaderSize {
+		return Event{}, false, fmt.Errorf("the event is truncated")
+	}
+	timestamp := binary.LittleEndian.Uint32(data[0:])
+	eventType := data[4]
+	size := binary.LittleEndian.Uint32(data[9:])
+	logPos := binary.LittleEndian.Uint32(data[13:])
+	if int(size) != len(data) {
+		return Event{}, false, fmt.Errorf("the event of type %d has %d bytes instead of %d", eventType, len(data), size)
+	}
+	// the format description event tells how the following events are checksummed, but is always checksummed itself
+	// when the server checksums the events
+	if s.checksum {
+		if len(data) < eventHeaderSize+4 {
+			return Event{}, false, fmt.Errorf("the event of type %d is truncated", eventType)
+		}
+		expected := binary.LittleEndian.Uint32(data[len(data)-4:])
+		data = data[:len(data)-4]
+		if crc32.ChecksumIEEE(data) != expected {
+			return Event{}, false, fmt.Errorf("the event of type %d at %s:%d has an invalid checksum", eventType, s.position.File, logPos)
+		}
+	}
+	body := data[eventHeaderSize:]
+	e := Event{Timestamp: time.Unix(int64(timestamp), 0)}
+	switch eventType {
+	case rotateEvent:
+		if len(body) < 8 {
+			return Event{}, false, fmt.Errorf("the rotate event is truncated")
+		}
+		s.position.File = string(body[8:])
+		s.position.Pos = uint32(binary.LittleEndian.Uint64(body))
+		return Event{}, false, nil
+	case heartbeatEvent, formatDescriptionEvent:
+		return Event{}, false, nil
+	}
+	if logPos > 0 {
+		s.position.Pos = logPos
+	}
+	switch eventType {
+	case gtidEvent:
+		if len(body) < 25 {
+			return Event{}, false, fmt.Errorf("the GTID event is truncated")
+		}
+		s.gtid = formatSID(body[1:17])
+		s.gno = int64(binary.LittleEndian.Uint64(body[17:]))
+		return Event{}, false, nil
+	case tableMapEvent:
+		return Event{}, false, s.parseTableMap(body)
+	case writeRowsEventV1, writeRowsEventV2, updateRowsEventV1, updateRowsEventV2, deleteRowsEventV1, deleteRowsEventV2:
+		rows, err := s.parseRows(eventType, body)
+		if err != nil || rows == nil {
+			return Event{}, false, err
+		}
+		e.Rows = rows
+	case xidEvent:
+		e.Commit = true
+	case queryEvent:
+		query, err := parseQuery(body)
+		if err != nil {
+			return Event{}, false, err
+		}
+		// every statement but the one starting a transaction is a transaction itself, such as a DDL
+		if query == "BEGIN" {
+			return Event{}, false, nil
+		}
+		e.Commit = true
+	default:
+		return Event{}, false, nil
+	}
+	if e.Commit && s.gtid != "" {
+		s.gtids.Add(s.gtid, s.gno)
+		s.gtid = ""
+		if s.position.GTIDSet != "" {
+			s.position.GTIDSet = s.gtids.String()
+		}
+	}
+	e.Position = s.position
+	return e, true, nil
+}
+
+// parseQuery returns the statement of a query event.
+func parseQuery(body []byte) (string, error) {
+	if len(body) < 13 {
+		return "", fmt.Errorf("the query event is truncated")
+	}
+	schemaLength := int(body[8])
+	statusLength := int(binary.LittleEndian.Uint16(body[11:]))
+	start := 13 + statusLength + schemaLength + 1
+	if start > len(body) {
+		return "", fmt.Errorf("the query event is truncated")
+	}
+	return string(body[start:]), nil
+}
+
+// parseTableMap records the table a table map event describes, which the following row events refer to by its ID.
+// Tables the stream does not decode the rows of are forgotten, so their row events are skipped.
+func (s *Stream) parseTableMap(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("the table map event is truncated")
+	}
+	id := readTableID(body)
+	r := reader{data: body[8:]}
+	t := &table{}
+	t.schema = string(r.bytes(int(r.byte())))
+	r.skip(1)
+	t.name = string(r.bytes(int(r.byte())))
+	r.skip(1)
+	if r.err != nil {
+		return fmt.Errorf("the table map event is truncated")
+	}
+	if !s.decodes(t.schema, t.name) {
+		delete(s.tables, id)
+		return nil
+	}
+	t.types = r.bytes(int(r.lengthEncoded()))
+	metaData := r.bytes(int(r.lengthEncoded()))
+	if r.err != nil {
+		return fmt.Errorf("the table map event is truncated")
+	}
+	meta, err := readMeta(metaData, t.types)
+	if err != nil {
+		return err
+	}
+	t.meta = meta
+	s.tables[id] = t
+	return nil
+}
+
+// decodes tells whether the stream decodes the rows of the given table.
+func (s *Stream) decodes(schema, name string) bool {
+	if len(s.config.Tables) == 0 {
+		return true
+	}
+	for _, t := range s.config.Tables {
+		if t == schema+"."+name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRows parses a row event of a mapped table, or returns nil when the table is unknown or skipped.
+func (s *Stream) parseRows(eventType byte, body []byte) (*RowsEvent, error) {
+	if len(body) < 8 {
+		return nil, fmt.Errorf("the rows event is truncated")
+	}
+	t, ok := s.tables[readTableID(body)]
+	if !ok {
+		return nil, nil
+	}
+	r := reader{data: body[8:]}
+	switch eventType {
+	case writeRowsEventV2, updateRowsEventV2, deleteRowsEventV2:
+		r.skip(int(r.uint16()) - 2)
+	}
+	rows := &RowsEvent{Schema: t.schema, Table: t.name}
+	update := false
+	switch eventType {
+	case writeRowsEventV1, writeRowsEventV2:
+		rows.Action = Insert
+	case updateRowsEventV1, updateRowsEventV2:
+		rows.Action = Update
+		update = true
+	default:
+		rows.Action = Delete
+	}
+	count := int(r.lengthEncoded())
+	if count != len(t.types) {
+		return nil, fmt.Errorf("the rows event of %s.%s has %d columns instead of %d", t.schema, t.name, count, len(t.types))
+	}
+	present := r.bytes((count + 7) / 8)
+	presentAfter := present
+	if update {
+		presentAfter = r.bytes((count + 7) / 8)
+	}
+	for r.err == nil && len(r.data) > 0 {
+		row, err := s.parseRow(&r, t, present)
+		if err != nil {
+			return nil, err
+		}
+		rows.Rows = append(rows.Rows, row)
+		if update {
+			if row, err = s.parseRow(&r, t, presentAfter); err != nil {
+				return nil, err
+			}
+			rows.Rows = append(rows.Rows, row)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("the rows event of %s.%s is truncated", t.schema, t.name)
+	}
+	return rows, nil
+}
+
+// parseRow parses the image of a row, which includes the given columns, preceded by a bitmap of the ones that are
+// NULL.
+func (s *Stream) parseRow(r *reader, t *table, present []byte) ([]interface{}, error) {
+	included := 0
+	for i := range t.types {
+		if isSet(present, i) {
+			included++
+		}
+	}
+	nulls := r.bytes((included + 7) / 8)
+	if r.err != nil {
+		return nil, r.err
+	}
+	row := make([]interface{}, len(t.types))
+	n := 0
+	for i, columnType := range t.types {
+		if !isSet(present, i) {
+			continue
+		}
+		isNull := isSet(nulls, n)
+		n++
+		if isNull {
+			continue
+		}
+		value, size, err := decodeValue(r.data, columnType, t.meta[i])
+		if err != nil {
+			return nil, fmt.Errorf("an error occured while decoding the column %d of %s.%s: %w", i, t.schema, t.name, err)
+		}
+		row[i] = value
+		r.skip(size)
+	}
+	return row, nil
+}
+
+func isSet(bitmap []byte, i int) bool {
+	return bitmap[i/8]&(1<<(uint(i)%8)) != 0
+}
+
+// readTableID reads the 6 bytes table ID that starts the post header of the table map and rows events.
+func readTableID(body []byte) uint64 {
+	return littleEndian(body[:6])
+}
+
+// reader reads the fields of an event, remembering whether it ran out of data.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = fmt.Errorf("truncated")
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) byte() byte {
+	value := r.bytes(1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (r *reader) uint16() uint16 {
+	value := r.bytes(2)
+	if value == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(value)
+}
+
+// lengthEncoded reads a length encoded integer.
+func (r *reader) lengthEncoded() uint64 {
+	first := r.byte()
+	switch first {
+	case 0xfc:
+		return littleEndian(r.bytes(2))
+	case 0xfd:
+		return littleEndian(r.bytes(3))
+	case 0xfe:
+		return littleEndian(r.bytes(8))
+	}
+	return uint64(first)
+}
@@ -0,0 +1,191 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filmTableMap is the table map event of sakila.film(film_id SMALLINT, title VARCHAR(255) utf8, release_year YEAR,
+// last_update TIMESTAMP, deleted_at DATETIME, flags BIT(10)), mapped to the table ID 108.
+const filmTableMap = "6c0000000000" + "0100" +
+	"06" + "73616b696c61" + "00" + // sakila
+	"04" + "66696c6d" + "00" + // film
+	"06" + "020f0d111210" + // types
+	"06" + "fd02" + "00" + "00" + "0201" + // metadata: varchar(765 bytes), timestamp2(0), datetime2(0), bit(2 bits, 1 byte)
+	"3e" // nullable columns
+
+// actorTableMap is the table map event of sakila.actor(actor_id SMALLINT), mapped to the table ID 109.
+const actorTableMap = "6d0000000000" + "0100" +
+	"06" + "73616b696c61" + "00" + // sakila
+	"05" + "6163746f72" + "00" + // actor
+	"01" + "02" + // types
+	"00" + // metadata
+	"00" // nullable columns
+
+// filmRow is the image of the film 42, whose deleted_at is NULL.
+const filmRow = "10" + // NULL bitmap
+	"2a00" + // film_id
+	"1000" + "41434144454d592044494e4f53415552" + // title: ACADEMY DINOSAUR
+	"6a" + // release_year: 2006
+	"615c4670" + // last_update: 2021-10-05 12:34:56
+	"0201" // flags
+
+// filmRowUpdated is the image of the film 42 once deleted.
+const filmRowUpdated = "00" + // NULL bitmap
+	"2a00" + // film_id
+	"1000" + "41434144454d592044494e4f53415552" + // title: ACADEMY DINOSAUR
+	"6a" + // release_year: 2006
+	"615c4670" + // last_update: 2021-10-05 12:34:56
+	"99aacac8b8" + // deleted_at: 2021-10-05 12:34:56
+	"0201" // flags
+
+// event returns the packet body of an event of the given type, ending at the given position, with the given hex
+// encoded body.
+func event(t *testing.T, eventType byte, logPos uint32, body string) []byte {
+	t.Helper()
+	raw, err := hex.DecodeString(body)
+	if err != nil {
+		t.Fatalf("invalid event body: %v", err)
+	}
+	header := binary.LittleEndian.AppendUint32(nil, uint32(time.Date(2021, 10, 5, 12, 34, 56, 0, time.UTC).Unix()))
+	header = append(header, eventType)
+	header = binary.LittleEndian.AppendUint32(header, 1)
+	header = binary.LittleEndian.AppendUint32(header, uint32(eventHeaderSize+len(raw)))
+	header = binary.LittleEndian.AppendUint32(header, logPos)
+	header = binary.LittleEndian.AppendUint16(header, 0)
+	return append(header, raw...)
+}
+
+func newStream(config Config) *Stream {
+	return &Stream{config: config, position: Position{File: "binlog.000001", Pos: 4}, gtids: GTIDSet{}, tables: make(map[uint64]*table)}
+}
+
+func TestParseRows(t *testing.T) {
+	lastUpdate := time.Date(2021, 10, 5, 12, 34, 56, 0, time.UTC)
+	before := []interface{}{uint64(42), "ACADEMY DINOSAUR", uint64(2006), lastUpdate, nil, []byte{0x02, 0x01}}
+	after := []interface{}{uint64(42), "ACADEMY DINOSAUR", uint64(2006), lastUpdate, lastUpdate, []byte{0x02, 0x01}}
+	tests := []struct {
+		name      string
+		eventType byte
+		body      string
+		want      *RowsEvent
+	}{
+		{
+			name:      "insert",
+			eventType: writeRowsEventV2,
+			body:      "6c0000000000" + "0100" + "0200" + "06" + "3f" + filmRow,
+			want:      &RowsEvent{Action: Insert, Schema: "sakila", Table: "film", Rows: [][]interface{}{before}},
+		},
+		{
+			name:      "update",
+			eventType: updateRowsEventV2,
+			body:      "6c0000000000" + "0100" + "0200" + "06" + "3f" + "3f" + filmRow + filmRowUpdated,
+			want:      &RowsEvent{Action: Update, Schema: "sakila", Table: "film", Rows: [][]interface{}{before, after}},
+		},
+		{
+			name:      "delete",
+			eventType: deleteRowsEventV1,
+			body:      "6c0000000000" + "0100" + "06" + "3f" + filmRow,
+			want:      &RowsEvent{Action: Delete, Schema: "sakila", Table: "film", Rows: [][]interface{}{before}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStream(Config{})
+			if _, ok, err := s.parse(event(t, tableMapEvent, 200, filmTableMap)); err != nil || ok {
+				t.Fatalf("parse(table map) = %v, %v, want false, nil", ok, err)
+			}
+			e, ok, err := s.parse(event(t, tt.eventType, 300, tt.body))
+			if err != nil || !ok {
+				t.Fatalf("parse(rows) = %v, %v, want true, nil", ok, err)
+			}
+			if !reflect.DeepEqual(e.Rows, tt.want) {
+				t.Errorf("parse(rows) = %#v, want %#v", e.Rows, tt.want)
+			}
+			if e.Position.Pos != 300 || e.Commit {
+				t.Errorf("parse(rows) is at %d, commit %v, want 300, false", e.Position.Pos, e.Commit)
+			}
+		})
+	}
+}
+
+func TestParseRowsSkipsOtherTables(t *testing.T) {
+	s := newStream(Config{Tables: []string{"sakila.film"}})
+	if _, _, err := s.parse(event(t, tableMapEvent, 200, actorTableMap)); err != nil {
+		t.Fatalf("parse(table map) = %v, want nil", err)
+	}
+	if len(s.tables) != 0 {
+		t.Errorf("the table sakila.actor is mapped, want it skipped")
+	}
+	// the rows event of a skipped table is not decoded, so its rows do not matter
+	if _, ok, err := s.parse(event(t, writeRowsEventV2, 300, "6d0000000000"+"0100"+"0200"+"ff")); err != nil || ok {
+		t.Errorf("parse(rows) = %v, %v, want false, nil", ok, err)
+	}
+	if _, _, err := s.parse(event(t, tableMapEvent, 400, filmTableMap)); err != nil {
+		t.Fatalf("parse(table map) = %v, want nil", err)
+	}
+	if _, ok := s.tables[108]; !ok {
+		t.Errorf("the table sakila.film is skipped, want it mapped")
+	}
+}
+
+func TestParseCommit(t *testing.T) {
+	s := newStream(Config{})
+	s.position.GTIDSet = "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"
+	s.gtids, _ = ParseGTIDSet(s.position.GTIDSet)
+	gtid := "00" + "3e11fa4771ca11e19e33c80aa9429562" + "0600000000000000"
+	if _, ok, err := s.parse(event(t, gtidEvent, 100, gtid)); err != nil || ok {
+		t.Fatalf("parse(gtid) = %v, %v, want false, nil", ok, err)
+	}
+	e, ok, err := s.parse(event(t, xidEvent, 500, "0100000000000000"))
+	if err != nil || !ok {
+		t.Fatalf("parse(xid) = %v, %v, want true, nil", ok, err)
+	}
+	want := Position{File: "binlog.000001", Pos: 500, GTIDSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6"}
+	if !e.Commit || e.Position != want {
+		t.Errorf("parse(xid) = %+v, commit %v, want %+v, true", e.Position, e.Commit, want)
+	}
+}
+
+func TestParseRotate(t *testing.T) {
+	s := newStream(Config{})
+	body := "0400000000000000" + hex.EncodeToString([]byte("binlog.000002"))
+	if _, ok, err := s.parse(event(t, rotateEvent, 0, body)); err != nil || ok {
+		t.Fatalf("parse(rotate) = %v, %v, want false, nil", ok, err)
+	}
+	if want := (Position{File: "binlog.000002", Pos: 4}); s.Position() != want {
+		t.Errorf("Position() = %+v, want %+v", s.Position(), want)
+	}
+}
+
+func TestGTIDSet(t *testing.T) {
+	set, err := ParseGTIDSet("3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5:11,\n 3E11FA47-71CA-11E1-9E33-C80AA9429562:6-8")
+	if err != nil {
+		t.Fatalf("ParseGTIDSet() = %v, want nil", err)
+	}
+	set.Add("3e11fa47-71ca-11e1-9e33-c80aa9429562", 10)
+	if want := "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-8:10-11"; set.String() != want {
+		t.Errorf("String() = %s, want %s", set, want)
+	}
+	encoded, err := set.encode()
+	if err != nil {
+		t.Fatalf("encode() = %v, want nil", err)
+	}
+	want, _ := hex.DecodeString(strings.Join([]string{
+		"0100000000000000",
+		"3e11fa4771ca11e19e33c80aa9429562", "0200000000000000",
+		"0100000000000000", "0900000000000000",
+		"0a00000000000000", "0c00000000000000",
+	}, ""))
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("encode() = %x, want %x", encoded, want)
+	}
+	if _, err = ParseGTIDSet("3e11fa47:1-5"); err == nil {
+		t.Errorf("ParseGTIDSet() = nil, want an error for an invalid server UUID")
+	}
+}
@@ -0,0 +1,207 @@
+package binlog
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxPacketSize = 1<<24 - 1
+
+// network is the network the dialer of the stream is registered for, once, since the driver can not forget a dialer.
+const network = "binlog"
+
+var registerDialer sync.Once
+
+// dialTarget is handed to the dialer of the stream through the context of a connection, telling it the actual network
+// of the server and the connection the dialed socket belongs to, since the driver only tells the dialer the address.
+type dialTarget struct {
+	network string
+	conn    *conn
+}
+
+type dialTargetKey struct{}
+
+// dialStream dials the socket of the connection of the stream found in the given context.
+func dialStream(ctx context.Context, addr string) (net.Conn, error) {
+	target, ok := ctx.Value(dialTargetKey{}).(dialTarget)
+	if !ok {
+		return nil, fmt.Errorf("the connection was not opened by the binlog stream")
+	}
+	netConn, err := (&net.Dialer{}).DialContext(ctx, target.network, addr)
+	if err == nil {
+		target.conn.netConn = netConn
+	}
+	return netConn, err
+}
+
+// conn is a connection to the server opened and authenticated by the MySQL driver, whose socket is then taken over to
+// speak the replication protocol, which the driver does not support.
+type conn struct {
+	db      *sql.DB
+	sqlConn *sql.Conn
+	netConn net.Conn
+	reader  *bufio.Reader
+	seq     byte
+}
+
+// dial opens a connection to the server of the given DSN. Until it is taken over, the connection is used through
+// database/sql to set the session up.
+func dial(ctx context.Context, dsn string) (*conn, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while parsing the DSN: %w", err)
+	}
+	if cfg.TLSConfig != "" && cfg.TLSConfig != "false" {
+		return nil, fmt.Errorf("TLS is not supported by the binlog stream")
+	}
+	target := dialTarget{network: cfg.Net, conn: &conn{}}
+	if target.network == "" {
+		target.network = "tcp"
+	}
+	registerDialer.Do(func() {
+		mysql.RegisterDialContext(network, dialStream)
+	})
+	cfg.Net = network
+	c := target.conn
+	c.db, err = sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while opening the connection: %w", err)
+	}
+	c.db.SetMaxOpenConns(1)
+	c.sqlConn, err = c.db.Conn(context.WithValue(ctx, dialTargetKey{}, target))
+	if err != nil {
+		_ = c.db.Close()
+		return nil, fmt.Errorf("an error occured while connecting: %w", err)
+	}
+	return c, nil
+}
+
+// exec runs the given statement on the session, before the connection is taken over.
+func (c *conn) exec(ctx context.Context, query string) error {
+	if _, err := c.sqlConn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("an error occured while running %q: %w", query, err)
+	}
+	return nil
+}
+
+// queryRow reads the first row of the given query as strings, before the connection is taken over. NULL columns are
+// read as empty strings.
+func (c *conn) queryRow(ctx context.Context, query string) ([]string, error) {
+	rows, err := c.sqlConn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while running %q: %w", query, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%q returned no row", query)
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return nil, fmt.Errorf("an error occured while reading %q: %w", query, err)
+	}
+	row := make([]string, len(values))
+	for i, value := range values {
+		row[i] = value.String
+	}
+	return row, nil
+}
+
+// takeOver makes the connection speak the protocol directly. The driver is done with the socket once its last
+// statement is answered, so nothing is left buffered by it.
+func (c *conn) takeOver() error {
+	if c.netConn == nil {
+		return fmt.Errorf("the connection was not dialed by the binlog stream")
+	}
+	c.reader = bufio.NewReaderSize(c.netConn, 64*1024)
+	return nil
+}
+
+// writeCommand sends the given command, which starts a new sequence of packets.
+func (c *conn) writeCommand(payload []byte) error {
+	c.seq = 0
+	for {
+		size := len(payload)
+		if size > maxPacketSize {
+			size = maxPacketSize
+		}
+		header := []byte{byte(size), byte(size >> 8), byte(size >> 16), c.seq}
+		c.seq++
+		if _, err := c.netConn.Write(append(header, payload[:size]...)); err != nil {
+			return fmt.Errorf("an error occured while writing to the server: %w", err)
+		}
+		payload = payload[size:]
+		if size < maxPacketSize {
+			return nil
+		}
+	}
+}
+
+// readPacket reads the next packet, joining the ones a large payload is split into, waiting at most the given timeout
+// when it is positive.
+func (c *conn) readPacket(timeout time.Duration) ([]byte, error) {
+	var payload []byte
+	for {
+		if timeout > 0 {
+			if err := c.netConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				return nil, err
+			}
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, fmt.Errorf("an error occured while reading from the server: %w", err)
+		}
+		size := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+		c.seq = header[3] + 1
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, chunk); err != nil {
+			return nil, fmt.Errorf("an error occured while reading from the server: %w", err)
+		}
+		payload = append(payload, chunk...)
+		if size < maxPacketSize {
+			return payload, nil
+		}
+	}
+}
+
+// close closes the socket along with the driver connection, whose own close fails on the socket already closed.
+func (c *conn) close() error {
+	if c.netConn != nil {
+		_ = c.netConn.Close()
+	}
+	if c.sqlConn != nil {
+		_ = c.sqlConn.Close()
+	}
+	return c.db.Close()
+}
+
+// serverError returns the error carried by an error packet.
+func serverError(packet []byte) error {
+	if len(packet) < 3 {
+		return fmt.Errorf("the server returned a malformed error")
+	}
+	code := binary.LittleEndian.Uint16(packet[1:3])
+	message := packet[3:]
+	if len(message) > 6 && message[0] == '#' {
+		message = message[6:]
+	}
+	return fmt.Errorf("the server returned the error %d: %s", code, message)
+}
@@ -0,0 +1,135 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// interval is a range of transaction numbers, whose end is excluded.
+type interval struct {
+	start, end int64
+}
+
+// GTIDSet is a set of global transaction IDs, as the intervals of the transaction numbers of each server UUID.
+type GTIDSet map[string][]interval
+
+// ParseGTIDSet parses a set written as MySQL does, such as 3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5:11,...
+func ParseGTIDSet(value string) (GTIDSet, error) {
+	set := GTIDSet{}
+	value = strings.Join(strings.Fields(value), "")
+	if value == "" {
+		return set, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.Split(part, ":")
+		sid := strings.ToLower(fields[0])
+		if _, err := sidBytes(sid); err != nil {
+			return nil, err
+		}
+		for _, field := range fields[1:] {
+			first, last, isRange := strings.Cut(field, "-")
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid GTID interval %q: %w", field, err)
+			}
+			end := start
+			if isRange {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid GTID interval %q: %w", field, err)
+				}
+			}
+			set.add(sid, interval{start: start, end: end + 1})
+		}
+	}
+	return set, nil
+}
+
+// Add adds the given transaction to the set.
+func (s GTIDSet) Add(sid string, gno int64) {
+	s.add(sid, interval{start: gno, end: gno + 1})
+}
+
+// add adds the given interval to the intervals of the given server UUID, merging the ones that overlap or are
+// adjacent, so the intervals are kept sorted and disjoint.
+func (s GTIDSet) add(sid string, i interval) {
+	intervals := append(s[sid], i)
+	sort.Slice(intervals, func(a, b int) bool {
+		return intervals[a].start < intervals[b].start
+	})
+	merged := intervals[:1]
+	for _, next := range intervals[1:] {
+		last := &merged[len(merged)-1]
+		if next.start <= last.end {
+			if next.end > last.end {
+				last.end = next.end
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	s[sid] = merged
+}
+
+// String writes the set as MySQL does.
+func (s GTIDSet) String() string {
+	sids := make([]string, 0, len(s))
+	for sid := range s {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	parts := make([]string, 0, len(sids))
+	for _, sid := range sids {
+		part := sid
+		for _, i := range s[sid] {
+			if i.end-i.start == 1 {
+				part += fmt.Sprintf(":%d", i.start)
+				continue
+			}
+			part += fmt.Sprintf(":%d-%d", i.start, i.end-1)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// encode encodes the set as the COM_BINLOG_DUMP_GTID command expects it.
+func (s GTIDSet) encode() ([]byte, error) {
+	sids := make([]string, 0, len(s))
+	for sid := range s {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	data := binary.LittleEndian.AppendUint64(nil, uint64(len(sids)))
+	for _, sid := range sids {
+		raw, err := sidBytes(sid)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, raw...)
+		data = binary.LittleEndian.AppendUint64(data, uint64(len(s[sid])))
+		for _, i := range s[sid] {
+			data = binary.LittleEndian.AppendUint64(data, uint64(i.start))
+			data = binary.LittleEndian.AppendUint64(data, uint64(i.end))
+		}
+	}
+	return data, nil
+}
+
+// sidBytes returns the 16 bytes of the given server UUID.
+func sidBytes(sid string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(sid, "-", ""))
+	if err != nil || len(raw) != 16 {
+		return nil, fmt.Errorf("invalid GTID server UUID %q", sid)
+	}
+	return raw, nil
+}
+
+// formatSID writes the given 16 bytes as a server UUID.
+func formatSID(raw []byte) string {
+	h := hex.EncodeToString(raw)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,232 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Column types, as written in the table map events.
+const (
+	typeDecimal    = 0
+	typeTiny       = 1
+	typeShort      = 2
+	typeLong       = 3
+	typeFloat      = 4
+	typeDouble     = 5
+	typeNull       = 6
+	typeTimestamp  = 7
+	typeLongLong   = 8
+	typeInt24      = 9
+	typeDate       = 10
+	typeTime       = 11
+	typeDateTime   = 12
+	typeYear       = 13
+	typeNewDate    = 14
+	typeVarchar    = 15
+	typeBit        = 16
+	typeTimestamp2 = 17
+	typeDateTime2  = 18
+	typeTime2      = 19
+	typeJSON       = 245
+	typeNewDecimal = 246
+	typeEnum       = 247
+	typeSet        = 248
+	typeTinyBlob   = 249
+	typeMediumBlob = 250
+	typeLongBlob   = 251
+	typeBlob       = 252
+	typeVarString  = 253
+	typeString     = 254
+	typeGeometry   = 255
+)
+
+// digitsBytes is the number of bytes of the leftover digits of a decimal, by their number.
+var digitsBytes = []int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+// readMeta reads the metadata of each column of a table map event.
+func readMeta(data []byte, types []byte) ([]uint16, error) {
+	meta := make([]uint16, len(types))
+	pos := 0
+	for i, t := range types {
+		size := 0
+		switch t {
+		case typeFloat, typeDouble, typeBlob, typeGeometry, typeJSON, typeTimestamp2, typeDateTime2, typeTime2:
+			size = 1
+		case typeVarchar, typeVarString, typeBit, typeNewDecimal, typeString, typeEnum, typeSet:
+			size = 2
+		}
+		if pos+size > len(data) {
+			return nil, fmt.Errorf("the metadata of the column %d is truncated", i)
+		}
+		switch {
+		case size == 1:
+			meta[i] = uint16(data[pos])
+		case t == typeVarchar || t == typeVarString:
+			meta[i] = binary.LittleEndian.Uint16(data[pos:])
+		case size == 2:
+			meta[i] = binary.BigEndian.Uint16(data[pos:])
+		}
+		pos += size
+	}
+	return meta, nil
+}
+
+// decodeValue decodes the value of a column of the given type and metadata, returning how many bytes it takes.
+// Integers are decoded as unsigned, since the row events do not tell their signedness, strings as strings, blobs as
+// bytes, years as their number and times as UTC times. Values of other types are returned as their raw bytes.
+func decodeValue(data []byte, t byte, meta uint16) (interface{}, int, error) {
+	length := 0
+	if t == typeString {
+		if meta >= 256 {
+			realType := byte(meta >> 8)
+			if realType&0x30 != 0x30 {
+				length = int(uint16(meta&0xff) | uint16((realType&0x30)^0x30)<<4)
+				t = realType | 0x30
+			} else {
+				length = int(meta & 0xff)
+				t = realType
+			}
+		} else {
+			length = int(meta)
+		}
+	}
+	var size int
+	switch t {
+	case typeNull:
+		return nil, 0, nil
+	case typeTiny, typeYear:
+		size = 1
+	case typeShort:
+		size = 2
+	case typeInt24, typeDate, typeTime, typeNewDate:
+		size = 3
+	case typeLong, typeFloat, typeTimestamp:
+		size = 4
+	case typeLongLong, typeDouble, typeDateTime:
+		size = 8
+	case typeNewDecimal:
+		precision, scale := int(meta>>8), int(meta&0xff)
+		integral := precision - scale
+		size = integral/9*4 + digitsBytes[integral%9] + scale/9*4 + digitsBytes[scale%9]
+	case typeBit:
+		// the metadata holds the number of leftover bits, then the number of whole bytes
+		size = int(meta&0xff) + (int(meta>>8)+7)/8
+	case typeTimestamp2:
+		size = 4 + int(meta+1)/2
+	case typeDateTime2:
+		size = 5 + int(meta+1)/2
+	case typeTime2:
+		size = 3 + int(meta+1)/2
+	case typeEnum, typeSet:
+		size = int(meta & 0xff)
+	case typeBlob, typeGeometry, typeJSON, typeTinyBlob, typeMediumBlob, typeLongBlob:
+		return decodeBlob(data, int(meta))
+	case typeVarchar, typeVarString:
+		return decodeString(data, int(meta))
+	case typeString:
+		return decodeString(data, length)
+	default:
+		return nil, 0, fmt.Errorf("the column type %d is not supported", t)
+	}
+	if size > len(data) {
+		return nil, 0, fmt.Errorf("the value of type %d is truncated", t)
+	}
+	value := data[:size]
+	switch t {
+	case typeTiny, typeShort, typeInt24, typeLong, typeLongLong:
+		return littleEndian(value), size, nil
+	case typeYear:
+		if value[0] == 0 {
+			return uint64(0), size, nil
+		}
+		return uint64(1900 + int(value[0])), size, nil
+	case typeFloat:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(value))), size, nil
+	case typeDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(value)), size, nil
+	case typeTimestamp:
+		return time.Unix(int64(binary.LittleEndian.Uint32(value)), 0).UTC(), size, nil
+	case typeTimestamp2:
+		seconds := int64(binary.BigEndian.Uint32(value))
+		return time.Unix(seconds, fraction(value[4:])*int64(time.Microsecond)).UTC(), size, nil
+	case typeDateTime2:
+		return decodeDateTime2(value), size, nil
+	case typeEnum, typeSet:
+		return littleEndian(value), size, nil
+	}
+	return value, size, nil
+}
+
+// littleEndian decodes an unsigned little endian integer of up to 8 bytes.
+func littleEndian(data []byte) uint64 {
+	var value uint64
+	for i, b := range data {
+		value |= uint64(b) << (8 * i)
+	}
+	return value
+}
+
+// bigEndian decodes an unsigned big endian integer of up to 8 bytes.
+func bigEndian(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// fraction decodes the fractional seconds of a time as microseconds, whose precision depends on how many bytes they
+// take.
+func fraction(data []byte) int64 {
+	if len(data) == 0 {
+		return 0
+	}
+	value := int64(bigEndian(data))
+	for i := len(data); i < 3; i++ {
+		value *= 100
+	}
+	return value
+}
+
+// decodeDateTime2 decodes a datetime, which is packed as a big endian integer offset by 2^39.
+func decodeDateTime2(data []byte) time.Time {
+	packed := int64(bigEndian(data[:5])) - 0x8000000000
+	ymd := packed >> 17
+	ym := ymd >> 5
+	hms := packed % (1 << 17)
+	return time.Date(int(ym/13), time.Month(ym%13), int(ymd%(1<<5)), int(hms>>12), int((hms>>6)%(1<<6)), int(hms%(1<<6)),
+		int(fraction(data[5:])*int64(time.Microsecond)), time.UTC)
+}
+
+// decodeString decodes a string prefixed by its length, which takes a byte, or two when the column may be longer than
+// 255 bytes.
+func decodeString(data []byte, maxLength int) (interface{}, int, error) {
+	prefix := 1
+	if maxLength > 255 {
+		prefix = 2
+	}
+	if prefix > len(data) {
+		return nil, 0, fmt.Errorf("the length of a string is truncated")
+	}
+	length := int(littleEndian(data[:prefix]))
+	if prefix+length > len(data) {
+		return nil, 0, fmt.Errorf("a string is truncated")
+	}
+	return string(data[prefix : prefix+length]), prefix + length, nil
+}
+
+// decodeBlob decodes a blob prefixed by its length, which takes the given number of bytes.
+func decodeBlob(data []byte, prefix int) (interface{}, int, error) {
+	if prefix < 1 || prefix > 4 || prefix > len(data) {
+		return nil, 0, fmt.Errorf("the length of a blob is truncated")
+	}
+	length := int(littleEndian(data[:prefix]))
+	if prefix+length > len(data) {
+		return nil, 0, fmt.Errorf("a blob is truncated")
+	}
+	value := make([]byte, length)
+	copy(value, data[prefix:prefix+length])
+	return value, prefix + length, nil
+}
@@ -0,0 +1,107 @@
+package binlog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReadMeta(t *testing.T) {
+	types := []byte{typeLong, typeVarchar, typeBit, typeDateTime2, typeString, typeNewDecimal}
+	data := []byte{0xfd, 0x02, 0x02, 0x01, 0x03, 0xfe, 0x28, 0x0a, 0x02}
+	meta, err := readMeta(data, types)
+	if err != nil {
+		t.Fatalf("readMeta() = %v, want nil", err)
+	}
+	want := []uint16{0, 765, 0x0201, 3, 0xfe28, 0x0a02}
+	for i := range want {
+		if meta[i] != want[i] {
+			t.Errorf("the metadata of the column %d is %#x, want %#x", i, meta[i], want[i])
+		}
+	}
+	if _, err = readMeta(data[:3], types); err == nil {
+		t.Errorf("readMeta() = nil, want an error for truncated metadata")
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		columnType byte
+		meta       uint16
+		data       []byte
+		want       interface{}
+		size       int
+	}{
+		{name: "tiny", columnType: typeTiny, data: []byte{0xff}, want: uint64(255), size: 1},
+		{name: "long", columnType: typeLong, data: []byte{0x2a, 0x00, 0x00, 0x00, 0xff}, want: uint64(42), size: 4},
+		{name: "year", columnType: typeYear, data: []byte{0x6a}, want: uint64(2006), size: 1},
+		{name: "zero year", columnType: typeYear, data: []byte{0x00}, want: uint64(0), size: 1},
+		{name: "short varchar", columnType: typeVarchar, meta: 50, data: []byte{0x02, 'h', 'i', 'x'}, want: "hi", size: 3},
+		{name: "long varchar", columnType: typeVarchar, meta: 765, data: []byte{0x02, 0x00, 'h', 'i'}, want: "hi", size: 4},
+		{name: "char", columnType: typeString, meta: 0xfe3c, data: []byte{0x02, 'h', 'i'}, want: "hi", size: 3},
+		{name: "blob", columnType: typeBlob, meta: 2, data: []byte{0x02, 0x00, 0x01, 0x02}, want: []byte{0x01, 0x02}, size: 4},
+		{name: "enum", columnType: typeString, meta: 0xf701, data: []byte{0x03}, want: uint64(3), size: 1},
+		{
+			name:       "timestamp2",
+			columnType: typeTimestamp2,
+			meta:       3,
+			data:       []byte{0x61, 0x5c, 0x46, 0x70, 0x04, 0xd2},
+			want:       time.Date(2021, 10, 5, 12, 34, 56, 123400000, time.UTC),
+			size:       6,
+		},
+		{
+			name:       "datetime2",
+			columnType: typeDateTime2,
+			data:       []byte{0x99, 0xaa, 0xca, 0xc8, 0xb8},
+			want:       time.Date(2021, 10, 5, 12, 34, 56, 0, time.UTC),
+			size:       5,
+		},
+		{
+			name:       "datetime2 with microseconds",
+			columnType: typeDateTime2,
+			meta:       6,
+			data:       []byte{0x99, 0xaa, 0xca, 0xc8, 0xb8, 0x01, 0xe2, 0x40},
+			want:       time.Date(2021, 10, 5, 12, 34, 56, 123456000, time.UTC),
+			size:       8,
+		},
+		{name: "bit(1)", columnType: typeBit, meta: 0x0100, data: []byte{0x01, 0xff}, want: []byte{0x01}, size: 1},
+		{name: "bit(8)", columnType: typeBit, meta: 0x0001, data: []byte{0x80, 0xff}, want: []byte{0x80}, size: 1},
+		{name: "bit(10)", columnType: typeBit, meta: 0x0201, data: []byte{0x02, 0x01, 0xff}, want: []byte{0x02, 0x01}, size: 2},
+		{name: "bit(64)", columnType: typeBit, meta: 0x0008, data: make([]byte, 9), want: make([]byte, 8), size: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, size, err := decodeValue(tt.data, tt.columnType, tt.meta)
+			if err != nil {
+				t.Fatalf("decodeValue() = %v, want nil", err)
+			}
+			if size != tt.size {
+				t.Errorf("decodeValue() takes %d bytes, want %d", size, tt.size)
+			}
+			switch want := tt.want.(type) {
+			case []byte:
+				if got, ok := value.([]byte); !ok || !bytes.Equal(got, want) {
+					t.Errorf("decodeValue() = %#v, want %#v", value, want)
+				}
+			case time.Time:
+				if got, ok := value.(time.Time); !ok || !got.Equal(want) {
+					t.Errorf("decodeValue() = %v, want %v", value, want)
+				}
+			default:
+				if value != want {
+					t.Errorf("decodeValue() = %#v, want %#v", value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeValueTruncated(t *testing.T) {
+	if _, _, err := decodeValue([]byte{0x01}, typeLong, 0); err == nil {
+		t.Errorf("decodeValue() = nil, want an error for a truncated integer")
+	}
+	if _, _, err := decodeValue([]byte{0x05, 'h'}, typeVarchar, 50); err == nil {
+		t.Errorf("decodeValue() = nil, want an error for a truncated string")
+	}
+}
@@ -2,21 +2,32 @@ package catalogue
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/diegohordi/go-kafka/internal/conflict"
+	"github.com/diegohordi/go-kafka/internal/logging"
 	"github.com/go-chi/chi/v5"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type httpHandler struct {
 	service *Service
+	logger  *slog.Logger
 }
 
 func Setup(router *chi.Mux, service *Service) {
-	handler := &httpHandler{service: service}
+	handler := &httpHandler{service: service, logger: service.logger}
 	router.Group(func(group chi.Router) {
+		group.Get("/api/v1/catalogue", handler.ListFilms)
 		group.Post("/api/v1/catalogue", handler.InsertFilm)
 		group.Get("/api/v1/catalogue/{uuid}", handler.GetFilm)
 		group.Put("/api/v1/catalogue/{uuid}", handler.UpdateFilm)
+		group.Delete("/api/v1/catalogue/{uuid}", handler.DeleteFilm)
+		group.Get("/api/v1/conflicts", handler.ListConflicts)
+		group.Get("/api/v1/conflicts/{id}", handler.GetConflict)
+		group.Post("/api/v1/conflicts/{id}/resolve", handler.ResolveConflict)
 	})
 }
 
@@ -29,7 +40,7 @@ func (h httpHandler) InsertFilm(w http.ResponseWriter, r *http.Request) {
 	}
 	film, err := h.service.InsertFilm(ctx, *filmRequest)
 	if err != nil {
-		log.Println("ERROR: ", err)
+		h.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -37,6 +48,59 @@ func (h httpHandler) InsertFilm(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(film)
 }
 
+// ListFilms lists the films a page at a time, filtered by the title, year_from, year_to and updated_since (RFC 3339)
+// parameters, sorted by the sort (title, year or last_update) and order (asc or desc) parameters. The next page is
+// requested with the next_cursor of the previous one as the cursor parameter, along with the same filters and sort.
+func (h httpHandler) ListFilms(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query, err := parseListFilmsQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	page, err := h.service.ListFilms(ctx, query)
+	if errors.Is(err, ErrInvalidListQuery) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func parseListFilmsQuery(r *http.Request) (ListFilmsQuery, error) {
+	values := r.URL.Query()
+	query := ListFilmsQuery{
+		Title:  values.Get("title"),
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	var err error
+	for name, dst := range map[string]*int{"year_from": &query.YearFrom, "year_to": &query.YearTo, "limit": &query.Limit} {
+		if value := values.Get(name); value != "" {
+			if *dst, err = strconv.Atoi(value); err != nil {
+				return query, err
+			}
+		}
+	}
+	if value := values.Get("updated_since"); value != "" {
+		if query.UpdatedSince, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, err
+		}
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, ErrInvalidListQuery
+	}
+	return query, nil
+}
+
 func (h httpHandler) GetFilm(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	filmUUID := chi.URLParam(r, "uuid")
@@ -50,7 +114,7 @@ func (h httpHandler) GetFilm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("ERROR: ", err)
+		h.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -75,9 +139,95 @@ func (h httpHandler) UpdateFilm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Println("ERROR: ", err)
+		h.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	_ = json.NewEncoder(w).Encode(film)
 }
+
+func (h httpHandler) DeleteFilm(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	filmUUID := chi.URLParam(r, "uuid")
+	if filmUUID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	err := h.service.DeleteFilm(ctx, filmUUID)
+	if err == ErrNoFilmFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h httpHandler) ListConflicts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	conflicts, err := h.service.ListConflicts(ctx, r.URL.Query().Get("status"))
+	if err != nil {
+		h.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(conflicts)
+}
+
+func (h httpHandler) GetConflict(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	c, err := h.service.GetConflict(ctx, id)
+	if err == conflict.ErrNoConflictFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+func (h httpHandler) ResolveConflict(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resolveRequest := &struct {
+		Winner string `json:"winner"`
+	}{}
+	if err = json.NewDecoder(r.Body).Decode(resolveRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c, err := h.service.ResolveConflict(ctx, id, resolveRequest.Winner)
+	switch err {
+	case nil:
+		_ = json.NewEncoder(w).Encode(c)
+	case conflict.ErrNoConflictFound, ErrNoFilmFound:
+		w.WriteHeader(http.StatusNotFound)
+	case ErrInvalidWinner:
+		w.WriteHeader(http.StatusBadRequest)
+	case conflict.ErrConflictNotParked:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		h.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// logError logs the given error that failed the given request, along with its request ID.
+func (h httpHandler) logError(r *http.Request, err error) {
+	h.logger.Error("the request failed", logging.RequestIDKey, logging.RequestID(r.Context()), "method", r.Method, "path", r.URL.Path, "error", err)
+}
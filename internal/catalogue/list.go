@@ -0,0 +1,205 @@
+package catalogue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sort orders of the listed films. Films are always sorted by their ID as well, so the order is stable.
+const (
+	SortByTitle      = "title"
+	SortByYear       = "year"
+	SortByLastUpdate = "last_update"
+)
+
+const defaultListLimit = 20
+const maxListLimit = 100
+
+const listFilmsSQL = "select id, uuid, title, year, last_update from films"
+
+var ErrInvalidListQuery = errors.New("invalid list query")
+
+// ListFilmsQuery filters and sorts the listed films. Zero values mean no filter.
+type ListFilmsQuery struct {
+	// Title is a substring of the title, regardless of its case.
+	Title        string
+	YearFrom     int
+	YearTo       int
+	UpdatedSince time.Time
+	Sort         string
+	Descending   bool
+	Limit        int
+	// Cursor is the NextCursor of the previous page, whose films are followed by the page.
+	Cursor string
+}
+
+// FilmsPage is a page of the listed films. NextCursor is empty on the last page.
+type FilmsPage struct {
+	Films      []Film `json:"films"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// cursor is the position of the last film of a page in the sort order. The sort is kept along with it, so a cursor
+// is never applied to another order.
+type cursor struct {
+	Sort       string    `json:"s"`
+	Descending bool      `json:"d"`
+	ID         int       `json:"i"`
+	Title      string    `json:"t,omitempty"`
+	Year       int       `json:"y,omitempty"`
+	LastUpdate time.Time `json:"u,omitempty"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (cursor, error) {
+	c := cursor{}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, fmt.Errorf("%w: the cursor is malformed", ErrInvalidListQuery)
+	}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%w: the cursor is malformed", ErrInvalidListQuery)
+	}
+	return c, nil
+}
+
+// value returns the value of the sorted column of the given cursor.
+func (c cursor) value() interface{} {
+	switch c.Sort {
+	case SortByYear:
+		return c.Year
+	case SortByLastUpdate:
+		return c.LastUpdate
+	default:
+		return c.Title
+	}
+}
+
+func newCursor(query ListFilmsQuery, film Film) cursor {
+	return cursor{
+		Sort:       query.Sort,
+		Descending: query.Descending,
+		ID:         film.ID,
+		Title:      film.Title,
+		Year:       film.Year,
+		LastUpdate: film.LastUpdate,
+	}
+}
+
+// validate fills the defaults of the given query, telling why it is invalid otherwise.
+func (q *ListFilmsQuery) validate() error {
+	if q.Sort == "" {
+		q.Sort = SortByTitle
+	}
+	switch q.Sort {
+	case SortByTitle, SortByYear, SortByLastUpdate:
+	default:
+		return fmt.Errorf("%w: the sort %q is unknown", ErrInvalidListQuery, q.Sort)
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultListLimit
+	}
+	if q.Limit < 0 || q.Limit > maxListLimit {
+		return fmt.Errorf("%w: the limit must be between 1 and %d", ErrInvalidListQuery, maxListLimit)
+	}
+	if q.YearFrom != 0 && q.YearTo != 0 && q.YearFrom > q.YearTo {
+		return fmt.Errorf("%w: the year range is empty", ErrInvalidListQuery)
+	}
+	return nil
+}
+
+// sql builds the statement of the given query along with its arguments. Pages are found by the position of the last
+// film of the previous page, rather than by an offset, so a page costs the same however deep it is, and films changed
+// meanwhile are neither skipped nor repeated. One film more than the limit is selected, to know whether there is a
+// next page.
+func (q ListFilmsQuery) sql(after *cursor) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if q.Title != "" {
+		conditions = append(conditions, "title like ?")
+		args = append(args, "%"+escapeLike(q.Title)+"%")
+	}
+	if q.YearFrom != 0 {
+		conditions = append(conditions, "year >= ?")
+		args = append(args, q.YearFrom)
+	}
+	if q.YearTo != 0 {
+		conditions = append(conditions, "year <= ?")
+		args = append(args, q.YearTo)
+	}
+	if !q.UpdatedSince.IsZero() {
+		conditions = append(conditions, "last_update >= ?")
+		args = append(args, q.UpdatedSince)
+	}
+	direction, comparison := "asc", ">"
+	if q.Descending {
+		direction, comparison = "desc", "<"
+	}
+	if after != nil {
+		conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s ? or (%[1]s = ? and id %[2]s ?))", q.Sort, comparison))
+		args = append(args, after.value(), after.value(), after.ID)
+	}
+	query := listFilmsSQL
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	query += fmt.Sprintf(" order by %[1]s %[2]s, id %[2]s limit ?", q.Sort, direction)
+	args = append(args, q.Limit+1)
+	return query, args
+}
+
+// escapeLike escapes the wildcards of a like pattern.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// ListFilms returns a page of the films matching the given query.
+func (s *Service) ListFilms(ctx context.Context, query ListFilmsQuery) (FilmsPage, error) {
+	if err := query.validate(); err != nil {
+		return FilmsPage{}, err
+	}
+	var after *cursor
+	if query.Cursor != "" {
+		c, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return FilmsPage{}, err
+		}
+		if c.Sort != query.Sort || c.Descending != query.Descending {
+			return FilmsPage{}, fmt.Errorf("%w: the cursor belongs to another sort", ErrInvalidListQuery)
+		}
+		after = &c
+	}
+	ctx, cancel := s.dbConn.CreateContext(ctx)
+	defer cancel()
+	statement, args := query.sql(after)
+	rows, err := s.dbConn.DB().QueryContext(ctx, statement, args...)
+	if err != nil {
+		return FilmsPage{}, fmt.Errorf("an error occured while listing the films: %w", err)
+	}
+	defer rows.Close()
+	page := FilmsPage{Films: make([]Film, 0, query.Limit)}
+	for rows.Next() {
+		film := Film{}
+		if err = rows.Scan(&film.ID, &film.UUID, &film.Title, &film.Year, &film.LastUpdate); err != nil {
+			return FilmsPage{}, fmt.Errorf("an error occured while reading the films: %w", err)
+		}
+		page.Films = append(page.Films, film)
+	}
+	if err = rows.Err(); err != nil {
+		return FilmsPage{}, fmt.Errorf("an error occured while reading the films: %w", err)
+	}
+	if len(page.Films) > query.Limit {
+		page.Films = page.Films[:query.Limit]
+		page.NextCursor = newCursor(query, page.Films[query.Limit-1]).encode()
+	}
+	return page, nil
+}
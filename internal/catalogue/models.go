@@ -10,3 +10,12 @@ type Film struct {
 	Year       int       `json:"year"`
 	LastUpdate time.Time `json:"-"`
 }
+
+// SyncFilm is the film published to be synced with the legacy DB, along with the origin of the change and the hash of
+// its content, which allow consumers to recognise echoes of their own writes.
+type SyncFilm struct {
+	Film
+	Origin    string    `json:"origin"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -5,31 +5,69 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/diegohordi/go-kafka/internal/conflict"
 	"github.com/diegohordi/go-kafka/internal/database"
-	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/event"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/origin"
+	"github.com/diegohordi/go-kafka/internal/outbox"
+	"github.com/diegohordi/go-kafka/internal/tracing"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"time"
 )
 
 var ErrNoFilmFound = errors.New("no film found")
+var ErrInvalidWinner = errors.New("the winner is none of the conflict origins")
 
 const getFilmByUUIDSQL = "select id, uuid, title, year from films where uuid = ?;"
-const insertFilmSQL = "insert into films (uuid, title, year, last_update) values (?, ?, ?, ?)"
-const updateFilmSQL = "update films set title = ?, year = ?, last_update = ? where id = ?;"
+const insertFilmSQL = "insert into films (uuid, title, year, last_update, sync_origin, sync_hash) values (?, ?, ?, ?, ?, ?)"
+const updateFilmSQL = "update films set title = ?, year = ?, last_update = ?, sync_origin = ?, sync_hash = ? where id = ?;"
+const deleteFilmSQL = "delete from films where id = ?;"
+const lockFilmSQL = "select id from films where uuid = ? for update"
 
 type Service struct {
-	dbConn      database.Connection
-	kafkaClient kafka.Client
+	dbConn    database.Connection
+	conflicts *conflict.Store
+	logger    *slog.Logger
 }
 
-func NewService(dbConn database.Connection, kafkaClient kafka.Client) *Service {
-	return &Service{dbConn: dbConn, kafkaClient: kafkaClient}
+func NewService(dbConn database.Connection, logger *slog.Logger) *Service {
+	return &Service{dbConn: dbConn, conflicts: conflict.NewStore(dbConn), logger: logger}
 }
 
-func (s *Service) publishToSync(ctx context.Context, film Film) error {
-	ctx, cancel := context.WithTimeout(ctx, 5 * time.Second)
-	defer cancel()
-	return s.kafkaClient.Write(ctx, film)
+// newSyncFilm wraps the given film changed through the API to be synced with the legacy DB.
+func newSyncFilm(film Film) SyncFilm {
+	return SyncFilm{
+		Film:      film,
+		Origin:    origin.Catalogue,
+		Hash:      origin.Hash(film.Title, film.Year),
+		UpdatedAt: film.LastUpdate,
+	}
+}
+
+// enqueueSync stores the event of the given film change in the outbox, to be synced with the legacy DB. The event is
+// published in the trace of its span.
+func (s *Service) enqueueSync(ctx context.Context, tx *sql.Tx, eventType string, film SyncFilm) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "enqueueSync", trace.WithAttributes(
+		attribute.String("film.uuid", film.UUID),
+		attribute.String("event.type", eventType),
+	))
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
+	e, err := event.New(eventType, film.Origin, film)
+	if err != nil {
+		return err
+	}
+	if err = outbox.Enqueue(ctx, tx, film.UUID, e); err != nil {
+		return err
+	}
+	s.logger.Debug("film event enqueued", logging.RequestIDKey, logging.RequestID(ctx), "event_id", e.ID, "event_type", eventType, "film_uuid", film.UUID)
+	return nil
 }
 
 func (s *Service) InsertFilm(ctx context.Context, film Film) (Film, error) {
@@ -37,18 +75,21 @@ func (s *Service) InsertFilm(ctx context.Context, film Film) (Film, error) {
 	defer cancel()
 	film.UUID = uuid.New().String()
 	film.LastUpdate = time.Now()
-	res, err := s.dbConn.DB().ExecContext(dbCtx, insertFilmSQL, film.UUID, film.Title, film.Year, film.LastUpdate)
-	if err != nil {
-		return Film{}, fmt.Errorf("an error occured while inserting: %w", err)
-	}
-	rows, err := res.RowsAffected()
-	if err != nil {
-		return Film{}, fmt.Errorf("an error occured while inserting: %w", err)
-	}
-	if rows != 1 {
-		return Film{}, fmt.Errorf("an unexpected error occured and the given film was not inserted")
-	}
-	err = s.publishToSync(ctx, film)
+	err := s.dbConn.Transaction(dbCtx, func(tx *sql.Tx) error {
+		syncFilm := newSyncFilm(film)
+		res, err := tx.ExecContext(dbCtx, insertFilmSQL, film.UUID, film.Title, film.Year, film.LastUpdate, syncFilm.Origin, syncFilm.Hash)
+		if err != nil {
+			return fmt.Errorf("an error occured while inserting: %w", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("an error occured while inserting: %w", err)
+		}
+		if rows != 1 {
+			return fmt.Errorf("an unexpected error occured and the given film was not inserted")
+		}
+		return s.enqueueSync(dbCtx, tx, event.FilmCreated, syncFilm)
+	})
 	if err != nil {
 		return Film{}, err
 	}
@@ -82,22 +123,107 @@ func (s *Service) UpdateFilm(ctx context.Context, filmUUID string, film Film) (F
 		return Film{}, err
 	}
 	film.UUID = filmUUID
+	film.LastUpdate = time.Now()
 	dbCtx, cancel := s.dbConn.CreateContext(ctx)
 	defer cancel()
-	res, err := s.dbConn.DB().ExecContext(dbCtx, updateFilmSQL, film.Title, film.Year, time.Now(), existingFilm.ID)
+	err = s.dbConn.Transaction(dbCtx, func(tx *sql.Tx) error {
+		return s.updateFilm(dbCtx, tx, existingFilm.ID, film)
+	})
+	if err != nil {
+		return Film{}, err
+	}
+	return s.GetFilm(ctx, filmUUID)
+}
+
+// updateFilm writes the given film over the one with the given ID within the given transaction, to be synced with the
+// legacy DB.
+func (s *Service) updateFilm(ctx context.Context, tx *sql.Tx, id int, film Film) error {
+	syncFilm := newSyncFilm(film)
+	res, err := tx.ExecContext(ctx, updateFilmSQL, film.Title, film.Year, film.LastUpdate, syncFilm.Origin, syncFilm.Hash, id)
 	if err != nil {
-		return Film{}, fmt.Errorf("an error occured while inserting: %w", err)
+		return fmt.Errorf("an error occured while updating: %w", err)
 	}
 	rows, err := res.RowsAffected()
 	if err != nil {
-		return Film{}, fmt.Errorf("an error occured while updating: %w", err)
+		return fmt.Errorf("an error occured while updating: %w", err)
 	}
 	if rows != 1 {
-		return Film{}, fmt.Errorf("an unexpected error occured and the given film was not updated")
+		return fmt.Errorf("an unexpected error occured and the given film was not updated")
 	}
-	err = s.publishToSync(ctx, film)
+	return s.enqueueSync(ctx, tx, event.FilmUpdated, syncFilm)
+}
+
+func (s *Service) DeleteFilm(ctx context.Context, filmUUID string) error {
+	existingFilm, err := s.GetFilm(ctx, filmUUID)
 	if err != nil {
-		return Film{}, err
+		return err
 	}
-	return s.GetFilm(ctx, filmUUID)
+	existingFilm.LastUpdate = time.Now()
+	dbCtx, cancel := s.dbConn.CreateContext(ctx)
+	defer cancel()
+	return s.dbConn.Transaction(dbCtx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(dbCtx, deleteFilmSQL, existingFilm.ID)
+		if err != nil {
+			return fmt.Errorf("an error occured while deleting: %w", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("an error occured while deleting: %w", err)
+		}
+		if rows != 1 {
+			return fmt.Errorf("an unexpected error occured and the given film was not deleted")
+		}
+		return s.enqueueSync(dbCtx, tx, event.FilmDeleted, newSyncFilm(existingFilm))
+	})
+}
+
+func (s *Service) ListConflicts(ctx context.Context, status string) ([]conflict.Conflict, error) {
+	return s.conflicts.List(ctx, status)
+}
+
+func (s *Service) GetConflict(ctx context.Context, id int64) (conflict.Conflict, error) {
+	return s.conflicts.Get(ctx, id)
+}
+
+// ResolveConflict resolves the given parked conflict in favour of the version of the given origin, which is written
+// to the catalogue and synced with the legacy DB, so both converge. The conflict is locked, and the film written along
+// with its resolution, so concurrent resolutions of the same conflict write the film once.
+func (s *Service) ResolveConflict(ctx context.Context, id int64, winner string) (conflict.Conflict, error) {
+	dbCtx, cancel := s.dbConn.CreateContext(ctx)
+	defer cancel()
+	err := s.dbConn.Transaction(dbCtx, func(tx *sql.Tx) error {
+		c, err := s.conflicts.Lock(dbCtx, tx, id)
+		if err != nil {
+			return err
+		}
+		if c.Status != conflict.StatusParked {
+			return conflict.ErrConflictNotParked
+		}
+		var version conflict.Version
+		switch winner {
+		case c.Local.Origin:
+			version = c.Local
+		case c.Incoming.Origin:
+			version = c.Incoming
+		default:
+			return ErrInvalidWinner
+		}
+		var filmID int
+		err = tx.QueryRowContext(dbCtx, lockFilmSQL, c.FilmUUID).Scan(&filmID)
+		if err == sql.ErrNoRows {
+			return ErrNoFilmFound
+		}
+		if err != nil {
+			return fmt.Errorf("an error occured while searching the film: %w", err)
+		}
+		film := Film{UUID: c.FilmUUID, Title: version.Title, Year: version.Year, LastUpdate: time.Now()}
+		if err = s.updateFilm(dbCtx, tx, filmID, film); err != nil {
+			return err
+		}
+		return s.conflicts.Resolve(dbCtx, tx, id, winner)
+	})
+	if err != nil {
+		return conflict.Conflict{}, err
+	}
+	return s.conflicts.Get(ctx, id)
 }
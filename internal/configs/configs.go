@@ -4,69 +4,470 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kafka balancers. Murmur2 is the default since it partitions keys just like the Java producers, such as Kafka Connect.
+const (
+	BalancerMurmur2    = "murmur2"
+	BalancerHash       = "hash"
+	BalancerCRC32      = "crc32"
+	BalancerRoundRobin = "round_robin"
+	BalancerLeastBytes = "least_bytes"
+)
+
+// Kafka compression codecs of the written messages.
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+	CompressionLz4    = "lz4"
+	CompressionZstd   = "zstd"
+)
+
+// Kafka SASL mechanisms.
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// Levels of the logger.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
 )
 
 type DBConfigurer interface {
 	DSN() string
+	QueryTimeout() time.Duration
+	MaxOpenConns() int
+	MaxIdleConns() int
+	ConnMaxLifetime() time.Duration
 }
 
 type KafkaConfigurer interface {
 	DSN() string
+	Brokers() []string
 	Topic() string
-	Partition() int
+	GroupID() string
+	WriteTimeout() time.Duration
+	WriterBatchSize() int
+	WriterLinger() time.Duration
+	WriterCompression() string
+	WriterAsync() bool
+	DeadLetterTopic() string
+	MaxAttempts() int
+	RetryBackoff() time.Duration
+	MaxRetryBackoff() time.Duration
+	Balancer() string
+	Workers() int
+	ConsumerBatchSize() int
+	ConsumerBatchWait() time.Duration
+	ConsumerStallTimeout() time.Duration
+	TLS() TLSConfigurer
+	SASL() SASLConfigurer
+}
+
+type TLSConfigurer interface {
+	Enabled() bool
+	CAFile() string
+	CertFile() string
+	KeyFile() string
+	InsecureSkipVerify() bool
+}
+
+type SASLConfigurer interface {
+	Mechanism() string
+	Username() string
+	Password() string
 }
 
 type AppConfigurer interface {
 	Port() int
+	ReadTimeout() time.Duration
+	WriteTimeout() time.Duration
+	IdleTimeout() time.Duration
+	ShutdownTimeout() time.Duration
+	DrainTimeout() time.Duration
+	LogLevel() string
+}
+
+type ConflictConfigurer interface {
+	Strategy() string
+	Window() time.Duration
+	Fields() map[string]string
+	DSN() string
+	DB() DBConfigurer
+}
+
+type LegacyConfigurer interface {
+	DSN() string
+	DB() DBConfigurer
+}
+
+type TracingConfigurer interface {
+	Endpoint() string
+	Insecure() bool
+	SampleRatio() float64
+	ServiceName() string
 }
 
 type Configurer interface {
 	DB() DBConfigurer
 	Kafka() KafkaConfigurer
 	App() AppConfigurer
+	Conflict() ConflictConfigurer
+	Legacy() LegacyConfigurer
+	Tracing() TracingConfigurer
 }
 
 type config struct {
 	kafkaConfig
 	dbConfig
 	appConfig
+	conflictConfig
+	legacyConfig
+	tracingConfig
 }
 
 type dbConfig struct {
-	dsn string
+	dsn             string
+	queryTimeout    time.Duration
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
 }
 
 func (d dbConfig) DSN() string {
 	return d.dsn
 }
 
+// QueryTimeout returns how long a single database operation may take.
+func (d dbConfig) QueryTimeout() time.Duration {
+	return d.queryTimeout
+}
+
+// MaxOpenConns returns the size of the connection pool, where 0 means unlimited.
+func (d dbConfig) MaxOpenConns() int {
+	return d.maxOpenConns
+}
+
+// MaxIdleConns returns how many idle connections are kept in the pool.
+func (d dbConfig) MaxIdleConns() int {
+	return d.maxIdleConns
+}
+
+// ConnMaxLifetime returns how long a connection may be reused.
+func (d dbConfig) ConnMaxLifetime() time.Duration {
+	return d.connMaxLifetime
+}
+
 type kafkaConfig struct {
-	dsn       string
-	topic     string
-	partition int
+	brokers         []string
+	topic           string
+	groupID         string
+	writeTimeout    time.Duration
+	writerBatchSize int
+	writerLinger    time.Duration
+	compression     string
+	async           bool
+	deadLetterTopic string
+	maxAttempts     int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	balancer        string
+	workers         int
+	batchSize       int
+	batchWait       time.Duration
+	stallTimeout    time.Duration
+	tls             tlsConfig
+	sasl            saslConfig
 }
 
+// DSN returns the first broker, to bootstrap connections that need a single address.
 func (c kafkaConfig) DSN() string {
-	return c.dsn
+	if len(c.brokers) == 0 {
+		return ""
+	}
+	return c.brokers[0]
+}
+
+// Brokers returns the addresses of the Kafka brokers.
+func (c kafkaConfig) Brokers() []string {
+	return c.brokers
 }
 
 func (c kafkaConfig) Topic() string {
 	return c.topic
 }
 
-func (c kafkaConfig) Partition() int {
-	return c.partition
+// GroupID returns the consumer group ID, overriding the default group of each service when set.
+func (c kafkaConfig) GroupID() string {
+	return c.groupID
+}
+
+// WriteTimeout returns how long a write may wait for the brokers to acknowledge it.
+func (c kafkaConfig) WriteTimeout() time.Duration {
+	return c.writeTimeout
+}
+
+// WriterBatchSize returns how many messages are written to a partition at once.
+func (c kafkaConfig) WriterBatchSize() int {
+	return c.writerBatchSize
+}
+
+// WriterLinger returns how long a writer waits for a batch to be full before writing it.
+func (c kafkaConfig) WriterLinger() time.Duration {
+	return c.writerLinger
+}
+
+// WriterCompression returns the compression codec of the written messages.
+func (c kafkaConfig) WriterCompression() string {
+	return c.compression
+}
+
+// WriterAsync tells whether writes return before Kafka acknowledges them, reporting the outcome to a completion
+// function instead.
+func (c kafkaConfig) WriterAsync() bool {
+	return c.async
+}
+
+// DeadLetterTopic returns the topic where messages that could not be processed are sent to, which defaults to the
+// topic name suffixed by ".dlq".
+func (c kafkaConfig) DeadLetterTopic() string {
+	if c.deadLetterTopic == "" {
+		return c.topic + ".dlq"
+	}
+	return c.deadLetterTopic
+}
+
+// MaxAttempts returns how many times a message is processed before being sent to the dead-letter topic.
+func (c kafkaConfig) MaxAttempts() int {
+	return c.maxAttempts
+}
+
+// RetryBackoff returns how long to wait before the first retry, doubled at each following one.
+func (c kafkaConfig) RetryBackoff() time.Duration {
+	return c.retryBackoff
+}
+
+// MaxRetryBackoff returns the longest wait between retries.
+func (c kafkaConfig) MaxRetryBackoff() time.Duration {
+	return c.maxRetryBackoff
+}
+
+// Balancer returns the name of the balancer that distributes the written messages across partitions by their key.
+func (c kafkaConfig) Balancer() string {
+	return c.balancer
+}
+
+// Workers returns how many messages are processed concurrently by a consumer.
+func (c kafkaConfig) Workers() int {
+	return c.workers
+}
+
+// ConsumerBatchSize returns how many messages are processed at once by the consumers that support batches, where 0
+// means they process one message at a time.
+func (c kafkaConfig) ConsumerBatchSize() int {
+	return c.batchSize
+}
+
+// ConsumerBatchWait returns how long a consumer waits for a batch to be full once its first message is fetched.
+func (c kafkaConfig) ConsumerBatchWait() time.Duration {
+	return c.batchWait
+}
+
+// ConsumerStallTimeout returns how long a message may be processed before the consumer is considered stuck.
+func (c kafkaConfig) ConsumerStallTimeout() time.Duration {
+	return c.stallTimeout
+}
+
+// TLS returns the TLS settings of the connections to the brokers.
+func (c kafkaConfig) TLS() TLSConfigurer {
+	return c.tls
+}
+
+// SASL returns the credentials used to authenticate to the brokers.
+func (c kafkaConfig) SASL() SASLConfigurer {
+	return c.sasl
+}
+
+type tlsConfig struct {
+	enabled            bool
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+}
+
+// Enabled tells whether the brokers are connected over TLS, which is implied by any other TLS setting.
+func (t tlsConfig) Enabled() bool {
+	return t.enabled || t.caFile != "" || t.certFile != "" || t.insecureSkipVerify
+}
+
+// CAFile returns the PEM file of the CAs trusted to sign the certificates of the brokers, instead of the system ones.
+func (t tlsConfig) CAFile() string {
+	return t.caFile
+}
+
+// CertFile returns the PEM file of the client certificate, for brokers that authenticate clients by certificate.
+func (t tlsConfig) CertFile() string {
+	return t.certFile
+}
+
+// KeyFile returns the PEM file of the key of the client certificate.
+func (t tlsConfig) KeyFile() string {
+	return t.keyFile
+}
+
+// InsecureSkipVerify tells whether the certificates of the brokers are trusted without verification, which is only
+// meant for development clusters.
+func (t tlsConfig) InsecureSkipVerify() bool {
+	return t.insecureSkipVerify
+}
+
+type saslConfig struct {
+	mechanism string
+	username  string
+	password  string
+}
+
+// Mechanism returns the SASL mechanism, where an empty one means no authentication.
+func (s saslConfig) Mechanism() string {
+	return s.mechanism
+}
+
+func (s saslConfig) Username() string {
+	return s.username
+}
+
+func (s saslConfig) Password() string {
+	return s.password
 }
 
 type appConfig struct {
-	port int
+	port            int
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+	drainTimeout    time.Duration
+	logLevel        string
 }
 
 func (a appConfig) Port() int {
 	return a.port
 }
 
+func (a appConfig) ReadTimeout() time.Duration {
+	return a.readTimeout
+}
+
+func (a appConfig) WriteTimeout() time.Duration {
+	return a.writeTimeout
+}
+
+func (a appConfig) IdleTimeout() time.Duration {
+	return a.idleTimeout
+}
+
+// ShutdownTimeout returns how long the service may take to stop gracefully.
+func (a appConfig) ShutdownTimeout() time.Duration {
+	return a.shutdownTimeout
+}
+
+// DrainTimeout returns how long a consumer may take to finish the messages being processed once it is stopped.
+func (a appConfig) DrainTimeout() time.Duration {
+	return a.drainTimeout
+}
+
+// LogLevel returns the lowest level of the logged messages.
+func (a appConfig) LogLevel() string {
+	return a.logLevel
+}
+
+type conflictConfig struct {
+	strategy string
+	window   time.Duration
+	fields   map[string]string
+	db       dbConfig
+}
+
+// Strategy returns the name of the strategy used to resolve conflicting edits.
+func (c conflictConfig) Strategy() string {
+	return c.strategy
+}
+
+// Window returns how long before an incoming change a local edit is still considered concurrent.
+func (c conflictConfig) Window() time.Duration {
+	return c.window
+}
+
+// Fields returns the origin that is the source of truth of each field.
+func (c conflictConfig) Fields() map[string]string {
+	return c.fields
+}
+
+// DSN returns the DSN of the catalogue DB where conflicts are recorded, if it is not the DB of the service itself.
+func (c conflictConfig) DSN() string {
+	return c.db.dsn
+}
+
+// DB returns the settings of the catalogue DB where conflicts are recorded, which share the pool settings of the DB
+// of the service itself.
+func (c conflictConfig) DB() DBConfigurer {
+	return c.db
+}
+
+type legacyConfig struct {
+	db dbConfig
+}
+
+// DSN returns the DSN of the legacy DB, for the tools that read it along with the catalogue DB.
+func (l legacyConfig) DSN() string {
+	return l.db.dsn
+}
+
+// DB returns the settings of the legacy DB, which share the pool settings of the DB of the service itself.
+func (l legacyConfig) DB() DBConfigurer {
+	return l.db
+}
+
+type tracingConfig struct {
+	endpoint    string
+	insecure    bool
+	sampleRatio float64
+	serviceName string
+}
+
+// Endpoint returns the host and port of the OTLP HTTP collector the traces are exported to. Traces are not exported
+// when it is empty.
+func (t tracingConfig) Endpoint() string {
+	return t.endpoint
+}
+
+// Insecure tells whether the traces are exported over plain HTTP.
+func (t tracingConfig) Insecure() bool {
+	return t.insecure
+}
+
+// SampleRatio returns the ratio of the traces started by the service that are sampled, from 0 to 1.
+func (t tracingConfig) SampleRatio() float64 {
+	return t.sampleRatio
+}
+
+// ServiceName returns the name the service reports its traces with, if it is not the default name of the service.
+func (t tracingConfig) ServiceName() string {
+	return t.serviceName
+}
+
 func (c config) DB() DBConfigurer {
 	return c.dbConfig
 }
@@ -79,108 +480,460 @@ func (c config) App() AppConfigurer {
 	return c.appConfig
 }
 
-// Load loads the given configuration file.
-func Load(configPath string) (Configurer, error) {
-	data := &config{}
-	dbConf, err := loadDBConfig(configPath)
-	if err != nil {
-		return nil, err
+func (c config) Conflict() ConflictConfigurer {
+	return c.conflictConfig
+}
+
+func (c config) Legacy() LegacyConfigurer {
+	return c.legacyConfig
+}
+
+func (c config) Tracing() TracingConfigurer {
+	return c.tracingConfig
+}
+
+// ValidationError lists every invalid setting of a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// LoadOption changes the settings Load requires.
+type LoadOption func(*requirements)
+
+// requirements are the settings required besides the ones every service needs.
+type requirements struct {
+	kafka  bool
+	topic  bool
+	legacy bool
+}
+
+// WithoutKafka makes the Kafka settings optional, for the tools that only use the databases.
+func WithoutKafka() LoadOption {
+	return func(r *requirements) {
+		r.kafka = false
 	}
-	data.dbConfig = *dbConf
-	kafkaConf, err := loadKafkaConfig(configPath)
-	if err != nil {
-		return nil, err
+}
+
+// WithoutTopic makes the Kafka topic optional, for the tools that take the topics they write to from their flags.
+func WithoutTopic() LoadOption {
+	return func(r *requirements) {
+		r.topic = false
 	}
-	data.kafkaConfig = *kafkaConf
-	appConf, err := loadAppConfig(configPath)
-	if err != nil {
-		return nil, err
+}
+
+// WithLegacyDB makes the legacy DB settings required, for the tools that use both databases.
+func WithLegacyDB() LoadOption {
+	return func(r *requirements) {
+		r.legacy = true
 	}
-	data.appConfig = *appConf
-	return *data, nil
 }
 
-func loadAppConfig(configPath string) (*appConfig, error) {
-	appConf := &appConfig{}
-	appConf.port = 8080
-	if port, err := strconv.Atoi(os.Getenv("APP_PORT")); err == nil {
-		appConf.port = port
+// Load loads the configuration merging, in order of precedence, the environment variables, the given config file,
+// which may be either JSON or YAML, and the defaults. An empty path means only the environment is read.
+func Load(configPath string, opts ...LoadOption) (Configurer, error) {
+	required := requirements{kafka: true, topic: true}
+	for _, opt := range opts {
+		opt(&required)
 	}
+	s := defaultSettings()
 	if configPath != "" {
-		confDef := &struct {
-			App struct {
-				Port int    `json:"port"`
-			} `json:"app"`
-		}{}
-		configFile, err := os.Open(configPath)
-		if err != nil {
-			return nil, fmt.Errorf("an occurred while loading config file: %w", err)
-		}
-		err = json.NewDecoder(configFile).Decode(confDef)
-		if err != nil {
-			return nil, fmt.Errorf("an occurred while parsing config file: %w", err)
+		if err := s.loadFile(configPath); err != nil {
+			return nil, err
 		}
-		appConf.port = confDef.App.Port
 	}
-	return appConf, nil
+	problems := s.loadEnv(os.LookupEnv)
+	problems = append(problems, s.validate(required)...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return s.config(), nil
 }
 
-func loadDBConfig(configPath string) (*dbConfig, error) {
-	dbConf := &dbConfig{}
-	dbConf.dsn = os.Getenv("DATABASE_DSN")
-	if configPath != "" {
-		confDef := &struct {
-			DB struct {
-				DSN string `json:"dsn"`
-			} `json:"db"`
-		}{}
-		configFile, err := os.Open(configPath)
-		if err != nil {
-			return nil, fmt.Errorf("an occurred while loading config file: %w", err)
-		}
-		err = json.NewDecoder(configFile).Decode(confDef)
-		if err != nil {
-			return nil, fmt.Errorf("an occurred while parsing config file: %w", err)
-		}
-		dbConf.dsn = confDef.DB.DSN
+func MustLoad(configPath string, opts ...LoadOption) Configurer {
+	conf, err := Load(configPath, opts...)
+	if err != nil {
+		panic(err)
 	}
-	return dbConf, nil
+	return conf
 }
 
-func loadKafkaConfig(configPath string) (*kafkaConfig, error) {
-	kafkaConf := &kafkaConfig{}
-	kafkaConf.dsn = os.Getenv("KAFKA_DSN")
-	kafkaConf.topic = os.Getenv("KAFKA_TOPIC")
-	if partition, err := strconv.Atoi(os.Getenv("KAFKA_PARTITION")); err == nil {
-		kafkaConf.partition = partition
+// duration is a time.Duration written as a string such as "5s" in config files.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("a duration such as \"5s\" was expected: %w", err)
 	}
-	if configPath != "" {
-		confDef := &struct {
-			Kafka struct {
-				DSN       string `json:"dsn"`
-				Topic     string `json:"topic"`
-				Partition int    `json:"partition"`
-			} `json:"kafka"`
-		}{}
-		configFile, err := os.Open(configPath)
-		if err != nil {
-			return nil, fmt.Errorf("an occurred while loading config file: %w", err)
+	return d.parse(value)
+}
+
+func (d *duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+func (d *duration) parse(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// settings is the layout of the config files, which is also where defaults and environment variables are merged.
+type settings struct {
+	App      appSettings      `json:"app" yaml:"app"`
+	DB       dbSettings       `json:"db" yaml:"db"`
+	Kafka    kafkaSettings    `json:"kafka" yaml:"kafka"`
+	Conflict conflictSettings `json:"conflict" yaml:"conflict"`
+	Legacy   legacySettings   `json:"legacy" yaml:"legacy"`
+	Tracing  tracingSettings  `json:"tracing" yaml:"tracing"`
+}
+
+type appSettings struct {
+	Port            int      `json:"port" yaml:"port"`
+	ReadTimeout     duration `json:"read_timeout" yaml:"read_timeout"`
+	WriteTimeout    duration `json:"write_timeout" yaml:"write_timeout"`
+	IdleTimeout     duration `json:"idle_timeout" yaml:"idle_timeout"`
+	ShutdownTimeout duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	DrainTimeout    duration `json:"drain_timeout" yaml:"drain_timeout"`
+	LogLevel        string   `json:"log_level" yaml:"log_level"`
+}
+
+type dbSettings struct {
+	DSN             string   `json:"dsn" yaml:"dsn"`
+	QueryTimeout    duration `json:"query_timeout" yaml:"query_timeout"`
+	MaxOpenConns    int      `json:"max_open_conns" yaml:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns" yaml:"max_idle_conns"`
+	ConnMaxLifetime duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime"`
+}
+
+type kafkaSettings struct {
+	// DSN is a comma separated list of brokers, kept along with Brokers for the config files written before it.
+	DSN               string   `json:"dsn" yaml:"dsn"`
+	Brokers           []string `json:"brokers" yaml:"brokers"`
+	Topic             string   `json:"topic" yaml:"topic"`
+	GroupID           string   `json:"group_id" yaml:"group_id"`
+	WriteTimeout      duration `json:"write_timeout" yaml:"write_timeout"`
+	WriterBatchSize   int      `json:"writer_batch_size" yaml:"writer_batch_size"`
+	WriterLinger      duration `json:"writer_linger" yaml:"writer_linger"`
+	WriterCompression string   `json:"writer_compression" yaml:"writer_compression"`
+	WriterAsync       bool     `json:"writer_async" yaml:"writer_async"`
+	DeadLetterTopic   string   `json:"dead_letter_topic" yaml:"dead_letter_topic"`
+	MaxAttempts       int      `json:"max_attempts" yaml:"max_attempts"`
+	RetryBackoff      duration `json:"retry_backoff" yaml:"retry_backoff"`
+	MaxRetryBackoff   duration `json:"max_retry_backoff" yaml:"max_retry_backoff"`
+	Balancer          string   `json:"balancer" yaml:"balancer"`
+	Workers           int      `json:"workers" yaml:"workers"`
+	// ConsumerBatchSize and ConsumerBatchWait enable the batch mode of the consumers that support it.
+	ConsumerBatchSize    int      `json:"consumer_batch_size" yaml:"consumer_batch_size"`
+	ConsumerBatchWait    duration `json:"consumer_batch_wait" yaml:"consumer_batch_wait"`
+	ConsumerStallTimeout duration `json:"consumer_stall_timeout" yaml:"consumer_stall_timeout"`
+	TLS                  struct {
+		Enabled            bool   `json:"enabled" yaml:"enabled"`
+		CAFile             string `json:"ca_file" yaml:"ca_file"`
+		CertFile           string `json:"cert_file" yaml:"cert_file"`
+		KeyFile            string `json:"key_file" yaml:"key_file"`
+		InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	} `json:"tls" yaml:"tls"`
+	SASL struct {
+		Mechanism string `json:"mechanism" yaml:"mechanism"`
+		Username  string `json:"username" yaml:"username"`
+		Password  string `json:"password" yaml:"password"`
+	} `json:"sasl" yaml:"sasl"`
+}
+
+type conflictSettings struct {
+	Strategy string            `json:"strategy" yaml:"strategy"`
+	Window   duration          `json:"window" yaml:"window"`
+	Fields   map[string]string `json:"fields" yaml:"fields"`
+	DSN      string            `json:"dsn" yaml:"dsn"`
+}
+
+type legacySettings struct {
+	DSN string `json:"dsn" yaml:"dsn"`
+}
+
+type tracingSettings struct {
+	Endpoint    string  `json:"endpoint" yaml:"endpoint"`
+	Insecure    bool    `json:"insecure" yaml:"insecure"`
+	SampleRatio float64 `json:"sample_ratio" yaml:"sample_ratio"`
+	ServiceName string  `json:"service_name" yaml:"service_name"`
+}
+
+func defaultSettings() *settings {
+	s := &settings{}
+	s.App.Port = 8080
+	s.App.ReadTimeout = duration(5 * time.Second)
+	s.App.WriteTimeout = duration(10 * time.Second)
+	s.App.IdleTimeout = duration(15 * time.Second)
+	s.App.ShutdownTimeout = duration(5 * time.Second)
+	s.App.DrainTimeout = duration(30 * time.Second)
+	s.App.LogLevel = LogLevelInfo
+	s.DB.QueryTimeout = duration(5 * time.Second)
+	s.DB.MaxOpenConns = 10
+	s.DB.MaxIdleConns = 5
+	s.DB.ConnMaxLifetime = duration(3 * time.Minute)
+	s.Kafka.WriteTimeout = duration(5 * time.Second)
+	s.Kafka.WriterBatchSize = 100
+	s.Kafka.WriterLinger = duration(time.Second)
+	s.Kafka.WriterCompression = CompressionNone
+	s.Kafka.MaxAttempts = 5
+	s.Kafka.RetryBackoff = duration(200 * time.Millisecond)
+	s.Kafka.MaxRetryBackoff = duration(10 * time.Second)
+	s.Kafka.Balancer = BalancerMurmur2
+	s.Kafka.Workers = 4
+	s.Kafka.ConsumerBatchWait = duration(100 * time.Millisecond)
+	s.Kafka.ConsumerStallTimeout = duration(2 * time.Minute)
+	s.Conflict.Window = duration(5 * time.Second)
+	s.Tracing.SampleRatio = 1
+	return s
+}
+
+// loadFile merges the given config file over the current settings, so only the settings present in the file are
+// replaced.
+func (s *settings) loadFile(configPath string) error {
+	configFile, err := os.Open(configPath)
+	if err != nil {
+		return fmt.Errorf("an occurred while loading config file: %w", err)
+	}
+	defer configFile.Close()
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(configFile).Decode(s)
+	default:
+		err = json.NewDecoder(configFile).Decode(s)
+	}
+	if err != nil {
+		return fmt.Errorf("an occurred while parsing config file: %w", err)
+	}
+	return nil
+}
+
+// loadEnv merges the environment variables over the current settings, returning the ones that could not be parsed.
+func (s *settings) loadEnv(lookup func(string) (string, bool)) []string {
+	e := envLoader{lookup: lookup}
+	e.int("APP_PORT", &s.App.Port)
+	e.duration("APP_READ_TIMEOUT", &s.App.ReadTimeout)
+	e.duration("APP_WRITE_TIMEOUT", &s.App.WriteTimeout)
+	e.duration("APP_IDLE_TIMEOUT", &s.App.IdleTimeout)
+	e.duration("APP_SHUTDOWN_TIMEOUT", &s.App.ShutdownTimeout)
+	e.duration("APP_DRAIN_TIMEOUT", &s.App.DrainTimeout)
+	e.string("APP_LOG_LEVEL", &s.App.LogLevel)
+	e.string("DATABASE_DSN", &s.DB.DSN)
+	e.duration("DATABASE_QUERY_TIMEOUT", &s.DB.QueryTimeout)
+	e.int("DATABASE_MAX_OPEN_CONNS", &s.DB.MaxOpenConns)
+	e.int("DATABASE_MAX_IDLE_CONNS", &s.DB.MaxIdleConns)
+	e.duration("DATABASE_CONN_MAX_LIFETIME", &s.DB.ConnMaxLifetime)
+	if _, ok := e.get("KAFKA_DSN"); ok {
+		// the brokers of the file would otherwise take precedence over the DSN of the environment
+		s.Kafka.Brokers = nil
+	}
+	e.string("KAFKA_DSN", &s.Kafka.DSN)
+	e.list("KAFKA_BROKERS", &s.Kafka.Brokers)
+	e.string("KAFKA_TOPIC", &s.Kafka.Topic)
+	e.string("KAFKA_GROUP_ID", &s.Kafka.GroupID)
+	e.duration("KAFKA_WRITE_TIMEOUT", &s.Kafka.WriteTimeout)
+	e.int("KAFKA_WRITER_BATCH_SIZE", &s.Kafka.WriterBatchSize)
+	e.duration("KAFKA_WRITER_LINGER", &s.Kafka.WriterLinger)
+	e.string("KAFKA_WRITER_COMPRESSION", &s.Kafka.WriterCompression)
+	e.bool("KAFKA_WRITER_ASYNC", &s.Kafka.WriterAsync)
+	e.string("KAFKA_DEAD_LETTER_TOPIC", &s.Kafka.DeadLetterTopic)
+	e.int("KAFKA_MAX_ATTEMPTS", &s.Kafka.MaxAttempts)
+	e.duration("KAFKA_RETRY_BACKOFF", &s.Kafka.RetryBackoff)
+	e.duration("KAFKA_MAX_RETRY_BACKOFF", &s.Kafka.MaxRetryBackoff)
+	e.string("KAFKA_BALANCER", &s.Kafka.Balancer)
+	e.int("KAFKA_WORKERS", &s.Kafka.Workers)
+	e.int("KAFKA_CONSUMER_BATCH_SIZE", &s.Kafka.ConsumerBatchSize)
+	e.duration("KAFKA_CONSUMER_BATCH_WAIT", &s.Kafka.ConsumerBatchWait)
+	e.duration("KAFKA_CONSUMER_STALL_TIMEOUT", &s.Kafka.ConsumerStallTimeout)
+	e.bool("KAFKA_TLS_ENABLED", &s.Kafka.TLS.Enabled)
+	e.string("KAFKA_TLS_CA_FILE", &s.Kafka.TLS.CAFile)
+	e.string("KAFKA_TLS_CERT_FILE", &s.Kafka.TLS.CertFile)
+	e.string("KAFKA_TLS_KEY_FILE", &s.Kafka.TLS.KeyFile)
+	e.bool("KAFKA_TLS_INSECURE_SKIP_VERIFY", &s.Kafka.TLS.InsecureSkipVerify)
+	e.string("KAFKA_SASL_MECHANISM", &s.Kafka.SASL.Mechanism)
+	e.string("KAFKA_SASL_USERNAME", &s.Kafka.SASL.Username)
+	e.string("KAFKA_SASL_PASSWORD", &s.Kafka.SASL.Password)
+	e.string("CONFLICT_STRATEGY", &s.Conflict.Strategy)
+	e.duration("CONFLICT_WINDOW", &s.Conflict.Window)
+	e.pairs("CONFLICT_FIELDS", &s.Conflict.Fields)
+	e.string("CONFLICT_DSN", &s.Conflict.DSN)
+	e.string("LEGACY_DSN", &s.Legacy.DSN)
+	e.string("TRACING_ENDPOINT", &s.Tracing.Endpoint)
+	e.bool("TRACING_INSECURE", &s.Tracing.Insecure)
+	e.float("TRACING_SAMPLE_RATIO", &s.Tracing.SampleRatio)
+	e.string("TRACING_SERVICE_NAME", &s.Tracing.ServiceName)
+	return e.problems
+}
+
+// brokers returns the brokers list, falling back to the brokers of the DSN. Since a DSN set in the environment clears
+// the brokers of the file, the brokers of the environment win over its DSN, which wins over the file.
+func (s *settings) brokers() []string {
+	if len(s.Kafka.Brokers) > 0 {
+		return s.Kafka.Brokers
+	}
+	return splitList(s.Kafka.DSN)
+}
+
+// validate returns every invalid setting, given the settings that are required.
+func (s *settings) validate(required requirements) []string {
+	var problems []string
+	if s.DB.DSN == "" {
+		problems = append(problems, "db.dsn (DATABASE_DSN) is required")
+	}
+	if required.kafka && len(s.brokers()) == 0 {
+		problems = append(problems, "kafka.brokers (KAFKA_BROKERS) is required")
+	}
+	if required.kafka && required.topic && s.Kafka.Topic == "" {
+		problems = append(problems, "kafka.topic (KAFKA_TOPIC) is required")
+	}
+	if required.legacy && s.Legacy.DSN == "" {
+		problems = append(problems, "legacy.dsn (LEGACY_DSN) is required")
+	}
+	if s.App.Port <= 0 || s.App.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("app.port (APP_PORT) must be between 1 and 65535, got %d", s.App.Port))
+	}
+	switch s.App.LogLevel {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		problems = append(problems, fmt.Sprintf("app.log_level (APP_LOG_LEVEL) %q is unknown", s.App.LogLevel))
+	}
+	if s.Kafka.MaxAttempts < 1 {
+		problems = append(problems, fmt.Sprintf("kafka.max_attempts (KAFKA_MAX_ATTEMPTS) must be at least 1, got %d", s.Kafka.MaxAttempts))
+	}
+	if s.Kafka.Workers < 1 {
+		problems = append(problems, fmt.Sprintf("kafka.workers (KAFKA_WORKERS) must be at least 1, got %d", s.Kafka.Workers))
+	}
+	if s.Kafka.ConsumerBatchSize < 0 {
+		problems = append(problems, fmt.Sprintf("kafka.consumer_batch_size (KAFKA_CONSUMER_BATCH_SIZE) must not be negative, got %d", s.Kafka.ConsumerBatchSize))
+	}
+	if s.DB.MaxOpenConns < 0 || s.DB.MaxIdleConns < 0 {
+		problems = append(problems, "db.max_open_conns and db.max_idle_conns must not be negative")
+	}
+	switch s.Kafka.Balancer {
+	case BalancerMurmur2, BalancerHash, BalancerCRC32, BalancerRoundRobin, BalancerLeastBytes:
+	default:
+		problems = append(problems, fmt.Sprintf("kafka.balancer (KAFKA_BALANCER) %q is unknown", s.Kafka.Balancer))
+	}
+	if s.Kafka.WriterBatchSize < 1 {
+		problems = append(problems, fmt.Sprintf("kafka.writer_batch_size (KAFKA_WRITER_BATCH_SIZE) must be at least 1, got %d", s.Kafka.WriterBatchSize))
+	}
+	switch s.Kafka.WriterCompression {
+	case CompressionNone, CompressionGzip, CompressionSnappy, CompressionLz4, CompressionZstd:
+	default:
+		problems = append(problems, fmt.Sprintf("kafka.writer_compression (KAFKA_WRITER_COMPRESSION) %q is unknown", s.Kafka.WriterCompression))
+	}
+	if (s.Kafka.TLS.CertFile == "") != (s.Kafka.TLS.KeyFile == "") {
+		problems = append(problems, "kafka.tls.cert_file and kafka.tls.key_file must be given together")
+	}
+	switch s.Kafka.SASL.Mechanism {
+	case "":
+	case SASLPlain, SASLScramSHA256, SASLScramSHA512:
+		if s.Kafka.SASL.Username == "" {
+			problems = append(problems, "kafka.sasl.username (KAFKA_SASL_USERNAME) is required by the SASL mechanism")
 		}
-		err = json.NewDecoder(configFile).Decode(confDef)
-		if err != nil {
-			return nil, fmt.Errorf("an occurred while parsing config file: %w", err)
+	default:
+		problems = append(problems, fmt.Sprintf("kafka.sasl.mechanism (KAFKA_SASL_MECHANISM) %q is unknown", s.Kafka.SASL.Mechanism))
+	}
+	if s.Tracing.SampleRatio < 0 || s.Tracing.SampleRatio > 1 {
+		problems = append(problems, fmt.Sprintf("tracing.sample_ratio (TRACING_SAMPLE_RATIO) must be between 0 and 1, got %g", s.Tracing.SampleRatio))
+	}
+	timeouts := map[string]duration{
+		"app.read_timeout":             s.App.ReadTimeout,
+		"app.write_timeout":            s.App.WriteTimeout,
+		"app.idle_timeout":             s.App.IdleTimeout,
+		"app.drain_timeout":            s.App.DrainTimeout,
+		"app.shutdown_timeout":         s.App.ShutdownTimeout,
+		"db.query_timeout":             s.DB.QueryTimeout,
+		"kafka.consumer_batch_wait":    s.Kafka.ConsumerBatchWait,
+		"kafka.consumer_stall_timeout": s.Kafka.ConsumerStallTimeout,
+		"kafka.writer_linger":          s.Kafka.WriterLinger,
+		"kafka.write_timeout":          s.Kafka.WriteTimeout,
+		"kafka.retry_backoff":          s.Kafka.RetryBackoff,
+		"kafka.max_retry_backoff":      s.Kafka.MaxRetryBackoff,
+	}
+	for _, name := range sortedKeys(timeouts) {
+		if timeouts[name] <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", name))
 		}
-		kafkaConf.dsn = confDef.Kafka.DSN
-		kafkaConf.topic = confDef.Kafka.Topic
-		kafkaConf.partition = confDef.Kafka.Partition
 	}
-	return kafkaConf, nil
+	return problems
 }
 
-func MustLoad(configPath string) Configurer {
-	conf, err := Load(configPath)
-	if err != nil {
-		panic(err)
+func (s *settings) config() config {
+	db := dbConfig{
+		dsn:             s.DB.DSN,
+		queryTimeout:    time.Duration(s.DB.QueryTimeout),
+		maxOpenConns:    s.DB.MaxOpenConns,
+		maxIdleConns:    s.DB.MaxIdleConns,
+		connMaxLifetime: time.Duration(s.DB.ConnMaxLifetime),
+	}
+	conflictDB := db
+	conflictDB.dsn = s.Conflict.DSN
+	legacyDB := db
+	legacyDB.dsn = s.Legacy.DSN
+	return config{
+		appConfig: appConfig{
+			port:            s.App.Port,
+			readTimeout:     time.Duration(s.App.ReadTimeout),
+			writeTimeout:    time.Duration(s.App.WriteTimeout),
+			idleTimeout:     time.Duration(s.App.IdleTimeout),
+			shutdownTimeout: time.Duration(s.App.ShutdownTimeout),
+			drainTimeout:    time.Duration(s.App.DrainTimeout),
+			logLevel:        s.App.LogLevel,
+		},
+		dbConfig: db,
+		kafkaConfig: kafkaConfig{
+			brokers:         s.brokers(),
+			topic:           s.Kafka.Topic,
+			groupID:         s.Kafka.GroupID,
+			writeTimeout:    time.Duration(s.Kafka.WriteTimeout),
+			writerBatchSize: s.Kafka.WriterBatchSize,
+			writerLinger:    time.Duration(s.Kafka.WriterLinger),
+			compression:     s.Kafka.WriterCompression,
+			async:           s.Kafka.WriterAsync,
+			deadLetterTopic: s.Kafka.DeadLetterTopic,
+			maxAttempts:     s.Kafka.MaxAttempts,
+			retryBackoff:    time.Duration(s.Kafka.RetryBackoff),
+			maxRetryBackoff: time.Duration(s.Kafka.MaxRetryBackoff),
+			balancer:        s.Kafka.Balancer,
+			workers:         s.Kafka.Workers,
+			batchSize:       s.Kafka.ConsumerBatchSize,
+			batchWait:       time.Duration(s.Kafka.ConsumerBatchWait),
+			stallTimeout:    time.Duration(s.Kafka.ConsumerStallTimeout),
+			tls: tlsConfig{
+				enabled:            s.Kafka.TLS.Enabled,
+				caFile:             s.Kafka.TLS.CAFile,
+				certFile:           s.Kafka.TLS.CertFile,
+				keyFile:            s.Kafka.TLS.KeyFile,
+				insecureSkipVerify: s.Kafka.TLS.InsecureSkipVerify,
+			},
+			sasl: saslConfig{
+				mechanism: s.Kafka.SASL.Mechanism,
+				username:  s.Kafka.SASL.Username,
+				password:  s.Kafka.SASL.Password,
+			},
+		},
+		conflictConfig: conflictConfig{
+			strategy: s.Conflict.Strategy,
+			window:   time.Duration(s.Conflict.Window),
+			fields:   s.Conflict.Fields,
+			db:       conflictDB,
+		},
+		legacyConfig: legacyConfig{
+			db: legacyDB,
+		},
+		tracingConfig: tracingConfig{
+			endpoint:    s.Tracing.Endpoint,
+			insecure:    s.Tracing.Insecure,
+			sampleRatio: s.Tracing.SampleRatio,
+			serviceName: s.Tracing.ServiceName,
+		},
 	}
-	return conf
 }
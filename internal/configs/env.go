@@ -0,0 +1,122 @@
+package configs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envLoader reads environment variables into settings, collecting the ones that could not be parsed. Variables that
+// are not set keep the current value.
+type envLoader struct {
+	lookup   func(string) (string, bool)
+	problems []string
+}
+
+func (e *envLoader) get(name string) (string, bool) {
+	value, ok := e.lookup(name)
+	if !ok || value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+func (e *envLoader) string(name string, dst *string) {
+	if value, ok := e.get(name); ok {
+		*dst = value
+	}
+}
+
+func (e *envLoader) int(name string, dst *int) {
+	value, ok := e.get(name)
+	if !ok {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s must be an integer, got %q", name, value))
+		return
+	}
+	*dst = parsed
+}
+
+func (e *envLoader) bool(name string, dst *bool) {
+	value, ok := e.get(name)
+	if !ok {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s must be a boolean, got %q", name, value))
+		return
+	}
+	*dst = parsed
+}
+
+func (e *envLoader) float(name string, dst *float64) {
+	value, ok := e.get(name)
+	if !ok {
+		return
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s must be a number, got %q", name, value))
+		return
+	}
+	*dst = parsed
+}
+
+func (e *envLoader) duration(name string, dst *duration) {
+	value, ok := e.get(name)
+	if !ok {
+		return
+	}
+	if err := dst.parse(value); err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s must be a duration such as \"5s\", got %q", name, value))
+	}
+}
+
+// list reads a comma separated list.
+func (e *envLoader) list(name string, dst *[]string) {
+	if value, ok := e.get(name); ok {
+		*dst = splitList(value)
+	}
+}
+
+// pairs reads a comma separated list of key=value pairs, such as "title=legacy,year=catalogue".
+func (e *envLoader) pairs(name string, dst *map[string]string) {
+	value, ok := e.get(name)
+	if !ok {
+		return
+	}
+	parsed := make(map[string]string)
+	for _, pair := range splitList(value) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			e.problems = append(e.problems, fmt.Sprintf("%s must be a list of key=value pairs, got %q", name, value))
+			return
+		}
+		parsed[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	*dst = parsed
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func sortedKeys(m map[string]duration) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
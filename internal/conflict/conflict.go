@@ -0,0 +1,234 @@
+package conflict
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"log/slog"
+	"time"
+)
+
+const (
+	LastWriterWins = "last_writer_wins"
+	SourceOfTruth  = "source_of_truth"
+	Manual         = "manual"
+)
+
+const (
+	StatusResolved = "resolved"
+	StatusParked   = "parked"
+)
+
+const (
+	FieldTitle = "title"
+	FieldYear  = "year"
+)
+
+// Decision tells what should be done with the incoming change of a conflict.
+type Decision int
+
+const (
+	// Apply means the resolved version must be written over the local row.
+	Apply Decision = iota
+	// Keep means the local row must be kept as it is.
+	Keep
+	// Park means nothing must be written until the conflict is resolved manually.
+	Park
+)
+
+// Version is the content of a film on one of the sides of the sync, along with the origin of its last change.
+type Version struct {
+	Origin     string    `json:"origin"`
+	Title      string    `json:"title"`
+	Year       int       `json:"year"`
+	LastUpdate time.Time `json:"last_update"`
+}
+
+func (v Version) sameContent(other Version) bool {
+	return v.Title == other.Title && v.Year == other.Year
+}
+
+// Conflict is a concurrent edit of the same film in both databases.
+type Conflict struct {
+	ID         int64      `json:"id"`
+	FilmUUID   string     `json:"film_uuid"`
+	ExternalID int        `json:"external_id"`
+	DetectedBy string     `json:"detected_by"`
+	Strategy   string     `json:"strategy"`
+	Local      Version    `json:"local"`
+	Incoming   Version    `json:"incoming"`
+	Status     string     `json:"status"`
+	Resolution string     `json:"resolution,omitempty"`
+	DetectedAt time.Time  `json:"detected_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Resolver decides which version wins a conflict.
+type Resolver interface {
+	Strategy() string
+	Resolve(local, incoming Version) (Version, Decision)
+}
+
+// NewResolver creates the resolver of the configured strategy, which defaults to last writer wins.
+func NewResolver(config configs.ConflictConfigurer) (Resolver, error) {
+	switch config.Strategy() {
+	case "", LastWriterWins:
+		return lastWriterWins{}, nil
+	case SourceOfTruth:
+		for field, origin := range config.Fields() {
+			if field != FieldTitle && field != FieldYear {
+				return nil, fmt.Errorf("unknown conflict field %s", field)
+			}
+			if origin == "" {
+				return nil, fmt.Errorf("no source of truth was given for the conflict field %s", field)
+			}
+		}
+		return sourceOfTruth{fields: config.Fields()}, nil
+	case Manual:
+		return manual{}, nil
+	default:
+		return nil, fmt.Errorf("unknown conflict strategy %s", config.Strategy())
+	}
+}
+
+// Detect tells whether the incoming change conflicts with the local row, which happens when the local row was last
+// changed on its own side, holds something else, and was changed after the incoming change or shortly before it.
+func Detect(local, incoming Version, window time.Duration) bool {
+	if local.Origin == incoming.Origin || local.sameContent(incoming) {
+		return false
+	}
+	if local.LastUpdate.IsZero() || incoming.LastUpdate.IsZero() {
+		return false
+	}
+	return local.LastUpdate.After(incoming.LastUpdate.Add(-window))
+}
+
+// lastWriterWins keeps the version with the latest last update.
+type lastWriterWins struct{}
+
+func (lastWriterWins) Strategy() string {
+	return LastWriterWins
+}
+
+func (lastWriterWins) Resolve(local, incoming Version) (Version, Decision) {
+	if incoming.LastUpdate.Before(local.LastUpdate) {
+		return local, Keep
+	}
+	return incoming, Apply
+}
+
+// sourceOfTruth takes each field from the origin configured as its source of truth, falling back to the incoming
+// change for fields without one.
+type sourceOfTruth struct {
+	fields map[string]string
+}
+
+func (sourceOfTruth) Strategy() string {
+	return SourceOfTruth
+}
+
+func (r sourceOfTruth) Resolve(local, incoming Version) (Version, Decision) {
+	resolved := local
+	if r.wins(FieldTitle, incoming) {
+		resolved.Title = incoming.Title
+	}
+	if r.wins(FieldYear, incoming) {
+		resolved.Year = incoming.Year
+	}
+	if resolved.sameContent(local) {
+		return local, Keep
+	}
+	resolved.Origin = incoming.Origin
+	resolved.LastUpdate = incoming.LastUpdate
+	return resolved, Apply
+}
+
+func (r sourceOfTruth) wins(field string, incoming Version) bool {
+	origin, ok := r.fields[field]
+	return !ok || origin == incoming.Origin
+}
+
+// manual parks every conflict for manual review.
+type manual struct{}
+
+func (manual) Strategy() string {
+	return Manual
+}
+
+func (manual) Resolve(local, _ Version) (Version, Decision) {
+	return local, Park
+}
+
+type repairKey struct{}
+
+// WithRepair marks the change synced within the returned context as a repair, which is applied over the local row
+// without being checked for conflicts, since it is meant to make both sides converge.
+func WithRepair(ctx context.Context) context.Context {
+	return context.WithValue(ctx, repairKey{}, true)
+}
+
+func isRepair(ctx context.Context) bool {
+	repair, _ := ctx.Value(repairKey{}).(bool)
+	return repair
+}
+
+// Handler detects, resolves and records the conflicts found by one side of the sync.
+type Handler struct {
+	resolver   Resolver
+	store      *Store
+	window     time.Duration
+	detectedBy string
+	logger     *slog.Logger
+}
+
+// NewHandler creates a handler for the conflicts detected by the given origin. Conflicts are only logged when no store
+// is given.
+func NewHandler(config configs.ConflictConfigurer, store *Store, detectedBy string, logger *slog.Logger) (*Handler, error) {
+	resolver, err := NewResolver(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{resolver: resolver, store: store, window: config.Window(), detectedBy: detectedBy, logger: logger}, nil
+}
+
+// Handle returns the version that must be written over the local row, and whether anything must be written at all.
+// The conflict is recorded within the given transaction of the sync, which must be nil when the store is in another DB.
+// Repairs are always applied.
+func (h *Handler) Handle(ctx context.Context, tx *sql.Tx, filmUUID string, externalID int, local, incoming Version) (Version, bool, error) {
+	if isRepair(ctx) || !Detect(local, incoming, h.window) {
+		return incoming, true, nil
+	}
+	resolved, decision := h.resolver.Resolve(local, incoming)
+	conflict := Conflict{
+		FilmUUID:   filmUUID,
+		ExternalID: externalID,
+		DetectedBy: h.detectedBy,
+		Strategy:   h.resolver.Strategy(),
+		Local:      local,
+		Incoming:   incoming,
+		Status:     StatusResolved,
+		DetectedAt: time.Now(),
+	}
+	switch {
+	case decision == Park:
+		conflict.Status = StatusParked
+	case decision == Keep:
+		conflict.Resolution = local.Origin
+	case resolved.sameContent(incoming):
+		conflict.Resolution = incoming.Origin
+	default:
+		conflict.Resolution = "merged"
+	}
+	if conflict.Status == StatusResolved {
+		conflict.ResolvedAt = &conflict.DetectedAt
+	}
+	h.logger.Info("conflict detected", logging.RequestIDKey, logging.RequestID(ctx), "film_uuid", filmUUID, "external_id", externalID, "status", conflict.Status)
+	if h.store != nil {
+		if err := h.store.Record(ctx, tx, conflict); err != nil {
+			return Version{}, false, err
+		}
+	}
+	return resolved, decision == Apply, nil
+}
@@ -0,0 +1,149 @@
+package conflict
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/database"
+	"time"
+)
+
+var ErrNoConflictFound = errors.New("no conflict found")
+var ErrConflictNotParked = errors.New("the conflict is not parked")
+
+const conflictColumns = "id, film_uuid, external_id, detected_by, strategy, local_origin, local_title, local_year, local_last_update, incoming_origin, incoming_title, incoming_year, incoming_last_update, status, resolution, detected_at, resolved_at"
+
+// insertConflictSQL records a conflict unless the same one was already recorded, by an attempt of the same sync whose
+// transaction was rolled back after the conflict was recorded outside of it.
+const insertConflictSQL = "insert into conflicts (film_uuid, external_id, detected_by, strategy, local_origin, local_title, local_year, local_last_update, incoming_origin, incoming_title, incoming_year, incoming_last_update, status, resolution, detected_at, resolved_at) " +
+	"select ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? from dual where not exists (select id from conflicts " +
+	"where film_uuid <=> ? and detected_by = ? and local_last_update = ? and incoming_title = ? and incoming_year = ? and incoming_last_update = ?)"
+const listConflictsSQL = "select " + conflictColumns + " from conflicts order by id"
+const listConflictsByStatusSQL = "select " + conflictColumns + " from conflicts where status = ? order by id"
+const getConflictSQL = "select " + conflictColumns + " from conflicts where id = ?"
+const lockConflictSQL = getConflictSQL + " for update"
+const resolveConflictSQL = "update conflicts set status = ?, resolution = ?, resolved_at = ? where id = ? and status = ?"
+
+// Store records the detected conflicts in the catalogue DB.
+type Store struct {
+	dbConn database.Connection
+}
+
+func NewStore(dbConn database.Connection) *Store {
+	return &Store{dbConn: dbConn}
+}
+
+// Record stores the given conflict within the given transaction, so it is only recorded along with the sync that
+// detected it. Without a transaction, as when the store is in another DB than the synced one, the conflict is recorded
+// on its own, once, however many times the sync is retried.
+func (s *Store) Record(ctx context.Context, tx *sql.Tx, conflict Conflict) error {
+	args := []interface{}{
+		conflict.FilmUUID, conflict.ExternalID, conflict.DetectedBy, conflict.Strategy,
+		conflict.Local.Origin, conflict.Local.Title, conflict.Local.Year, conflict.Local.LastUpdate,
+		conflict.Incoming.Origin, conflict.Incoming.Title, conflict.Incoming.Year, conflict.Incoming.LastUpdate,
+		conflict.Status, conflict.Resolution, conflict.DetectedAt, conflict.ResolvedAt,
+		conflict.FilmUUID, conflict.DetectedBy, conflict.Local.LastUpdate,
+		conflict.Incoming.Title, conflict.Incoming.Year, conflict.Incoming.LastUpdate,
+	}
+	var err error
+	if tx != nil {
+		_, err = tx.ExecContext(ctx, insertConflictSQL, args...)
+	} else {
+		ctx, cancel := s.dbConn.CreateContext(ctx)
+		defer cancel()
+		_, err = s.dbConn.DB().ExecContext(ctx, insertConflictSQL, args...)
+	}
+	if err != nil {
+		return fmt.Errorf("an error occured while recording the conflict: %w", err)
+	}
+	return nil
+}
+
+// List returns the recorded conflicts, optionally filtered by status.
+func (s *Store) List(ctx context.Context, status string) ([]Conflict, error) {
+	ctx, cancel := s.dbConn.CreateContext(ctx)
+	defer cancel()
+	var rows *sql.Rows
+	var err error
+	if status == "" {
+		rows, err = s.dbConn.DB().QueryContext(ctx, listConflictsSQL)
+	} else {
+		rows, err = s.dbConn.DB().QueryContext(ctx, listConflictsByStatusSQL, status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while listing the conflicts: %w", err)
+	}
+	defer rows.Close()
+	conflicts := make([]Conflict, 0)
+	for rows.Next() {
+		conflict, err := scanConflict(rows)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// Get returns the conflict with the given ID.
+func (s *Store) Get(ctx context.Context, id int64) (Conflict, error) {
+	ctx, cancel := s.dbConn.CreateContext(ctx)
+	defer cancel()
+	conflict, err := scanConflict(s.dbConn.DB().QueryRowContext(ctx, getConflictSQL, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Conflict{}, ErrNoConflictFound
+	}
+	return conflict, err
+}
+
+// Lock returns the conflict with the given ID, locking it until the given transaction ends, so it is resolved once.
+func (s *Store) Lock(ctx context.Context, tx *sql.Tx, id int64) (Conflict, error) {
+	conflict, err := scanConflict(tx.QueryRowContext(ctx, lockConflictSQL, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Conflict{}, ErrNoConflictFound
+	}
+	return conflict, err
+}
+
+// Resolve marks the given parked conflict as resolved within the given transaction, along with the write of its
+// winner.
+func (s *Store) Resolve(ctx context.Context, tx *sql.Tx, id int64, resolution string) error {
+	res, err := tx.ExecContext(ctx, resolveConflictSQL, StatusResolved, resolution, time.Now(), id, StatusParked)
+	if err != nil {
+		return fmt.Errorf("an error occured while resolving the conflict: %w", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("an error occured while resolving the conflict: %w", err)
+	}
+	if rows != 1 {
+		return ErrConflictNotParked
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanConflict(row scanner) (Conflict, error) {
+	conflict := Conflict{}
+	var filmUUID, resolution sql.NullString
+	var externalID sql.NullInt64
+	var resolvedAt sql.NullTime
+	err := row.Scan(&conflict.ID, &filmUUID, &externalID, &conflict.DetectedBy, &conflict.Strategy,
+		&conflict.Local.Origin, &conflict.Local.Title, &conflict.Local.Year, &conflict.Local.LastUpdate,
+		&conflict.Incoming.Origin, &conflict.Incoming.Title, &conflict.Incoming.Year, &conflict.Incoming.LastUpdate,
+		&conflict.Status, &resolution, &conflict.DetectedAt, &resolvedAt)
+	if err != nil {
+		return Conflict{}, fmt.Errorf("an error occured while reading the conflict: %w", err)
+	}
+	conflict.FilmUUID = filmUUID.String
+	conflict.ExternalID = int(externalID.Int64)
+	conflict.Resolution = resolution.String
+	if resolvedAt.Valid {
+		conflict.ResolvedAt = &resolvedAt.Time
+	}
+	return conflict, nil
+}
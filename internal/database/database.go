@@ -3,34 +3,67 @@ package database
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"github.com/XSAM/otelsql"
 	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"github.com/diegohordi/go-kafka/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 	"log"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 type defaultConnection struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration
 }
 
 type Connection interface {
 	DB() *sql.DB
 	CreateContext(ctx context.Context) (context.Context, context.CancelFunc)
+	Transaction(ctx context.Context, fn func(tx *sql.Tx) error) error
+	Ping(ctx context.Context) error
 	Close()
 }
 
+// NewConnection creates a connection whose statements are traced as spans of the trace of their context, if any, so
+// the polling of the background jobs does not start traces of its own.
 func NewConnection(dbConfig configs.DBConfigurer) (Connection, error) {
-	db, err := sql.Open("mysql", dbConfig.DSN())
+	dsn, err := mysql.ParseDSN(dbConfig.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the DSN: %w", err)
+	}
+	dsn.ParseTime = true
+	// rows matched by an update count as affected even when it changes nothing, so reapplying a change never looks
+	// like a missing row
+	dsn.ClientFoundRows = true
+	db, err := otelsql.Open("mysql", dsn.FormatDSN(),
+		otelsql.WithAttributes(semconv.DBSystemMySQL, semconv.DBName(dsn.DBName)),
+		otelsql.WithMeterProvider(queryMeterProvider{}),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			DisableErrSkip:       true,
+			OmitConnResetSession: true,
+			OmitConnectorConnect: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("could not create a connection: %w", err)
 	}
-	db.SetConnMaxLifetime(time.Minute * 3)
+	db.SetConnMaxLifetime(dbConfig.ConnMaxLifetime())
+	db.SetMaxOpenConns(dbConfig.MaxOpenConns())
+	db.SetMaxIdleConns(dbConfig.MaxIdleConns())
 	if err = db.Ping(); err != nil {
 		return nil, fmt.Errorf("database is not reachable: %w", err)
 	}
-	return &defaultConnection{db: db}, nil
+	return &defaultConnection{db: db, queryTimeout: dbConfig.QueryTimeout()}, nil
 }
 
 func (d *defaultConnection) DB() *sql.DB {
@@ -38,8 +71,46 @@ func (d *defaultConnection) DB() *sql.DB {
 }
 
 func (d *defaultConnection) CreateContext(ctx context.Context) (context.Context, context.CancelFunc) {
-	timeout := 5 * time.Second
-	return context.WithTimeout(ctx, timeout)
+	return context.WithTimeout(ctx, d.queryTimeout)
+}
+
+// Transaction runs the given function inside a transaction, which is committed if the function succeeds and
+// rolled back otherwise. The transaction is traced as a span of the trace of the given context, if any.
+func (d *defaultConnection) Transaction(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	start := time.Now()
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		var span trace.Span
+		ctx, span = tracing.Tracer().Start(ctx, "db.transaction", trace.WithAttributes(semconv.DBSystemMySQL))
+		defer func() {
+			tracing.Fail(span, err)
+			span.End()
+		}()
+	}
+	defer func() {
+		metrics.ObserveTransaction(err == nil, time.Since(start))
+	}()
+	tx, err := d.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin the transaction: %w", err)
+	}
+	if err = fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("could not rollback the transaction %v\n", rbErr)
+		}
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit the transaction: %w", err)
+	}
+	return nil
+}
+
+// Ping tells whether the database is reachable.
+func (d *defaultConnection) Ping(ctx context.Context) error {
+	if err := d.DB().PingContext(ctx); err != nil {
+		return fmt.Errorf("database is not reachable: %w", err)
+	}
+	return nil
 }
 
 func (d *defaultConnection) Close() {
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"context"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"time"
+)
+
+// latencyInstrument is the histogram otelsql records the latency of every call to the driver in, in milliseconds.
+const latencyInstrument = "db.sql.latency"
+
+// queryMeterProvider hands otelsql a histogram that records the latency of every call to the driver as a Prometheus
+// metric, such as the queries run outside of transactions, leaving every other instrument out.
+type queryMeterProvider struct {
+	noop.MeterProvider
+}
+
+func (queryMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return queryMeter{}
+}
+
+type queryMeter struct {
+	noop.Meter
+}
+
+func (m queryMeter) Float64Histogram(name string, opts ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	if name != latencyInstrument {
+		return m.Meter.Float64Histogram(name, opts...)
+	}
+	return queryHistogram{}, nil
+}
+
+type queryHistogram struct {
+	noop.Float64Histogram
+}
+
+func (queryHistogram) Record(_ context.Context, milliseconds float64, opts ...metric.RecordOption) {
+	attrs := metric.NewRecordConfig(opts).Attributes()
+	method, _ := attrs.Value("method")
+	status, _ := attrs.Value("status")
+	metrics.ObserveQuery(method.AsString(), status.AsString(), time.Duration(milliseconds*float64(time.Millisecond)))
+}
@@ -0,0 +1,87 @@
+package dedup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/go-sql-driver/mysql"
+	"log/slog"
+	"time"
+)
+
+const trackEventSQL = "insert into processed_events (event_id, processed_at) values (?, ?)"
+const pruneEventsSQL = "delete from processed_events where processed_at < ? limit ?"
+
+// pruneBatchSize is how many processed events are deleted at once, so the pruning does not lock the table for long.
+const pruneBatchSize = 1000
+
+const duplicateEntryErrorNumber = 1062
+
+// EventID returns the given event ID, or identifies the message by its position when the event has none, such as
+// the events written before the envelope existed and the ones of the legacy connector.
+func EventID(eventID string, msg kafka.Message) string {
+	if eventID != "" {
+		return eventID
+	}
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// Track records the given event as processed within the given transaction, so it is only recorded along with the
+// changes it made. It returns false when the event was already processed, in which case it must be skipped.
+func Track(ctx context.Context, tx *sql.Tx, eventID string) (bool, error) {
+	_, err := tx.ExecContext(ctx, trackEventSQL, eventID, time.Now())
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == duplicateEntryErrorNumber {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("an error occured while tracking the event %s: %w", eventID, err)
+	}
+	return true, nil
+}
+
+// Prune deletes the events processed before the given time, a batch at a time, returning how many were deleted. The
+// events must be kept for as long as Kafka may redeliver them.
+func Prune(ctx context.Context, dbConn database.Connection, before time.Time) (int64, error) {
+	var pruned int64
+	for ctx.Err() == nil {
+		queryCtx, cancel := dbConn.CreateContext(ctx)
+		res, err := dbConn.DB().ExecContext(queryCtx, pruneEventsSQL, before, pruneBatchSize)
+		cancel()
+		if err != nil {
+			return pruned, fmt.Errorf("an error occured while pruning the processed events: %w", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return pruned, fmt.Errorf("an error occured while pruning the processed events: %w", err)
+		}
+		pruned += rows
+		if rows < pruneBatchSize {
+			break
+		}
+	}
+	return pruned, nil
+}
+
+// RunPruner prunes the events processed longer ago than the given retention every interval, until the given context
+// is done. A failed pruning is retried by the next one.
+func RunPruner(ctx context.Context, dbConn database.Connection, retention, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pruned, err := Prune(ctx, dbConn, time.Now().Add(-retention))
+		if err != nil && ctx.Err() == nil {
+			logger.Error("the processed events were not pruned", "error", err)
+		} else if pruned > 0 {
+			logger.Info("processed events pruned", "count", pruned)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
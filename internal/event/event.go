@@ -0,0 +1,85 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// SchemaVersion is the version of the envelope written by this code. Messages written before the envelope existed
+// are decoded as version 0.
+const SchemaVersion = 1
+
+const (
+	FilmCreated = "FilmCreated"
+	FilmUpdated = "FilmUpdated"
+	FilmDeleted = "FilmDeleted"
+	// FilmIdentityAssigned carries the UUID the catalogue assigned to a film created in the legacy DB, to be written
+	// back to the legacy row.
+	FilmIdentityAssigned = "FilmIdentityAssigned"
+)
+
+// Envelope wraps the payload of every event published to the catalogue topic.
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	Source        string          `json:"source"`
+	SchemaVersion int             `json:"schema_version"`
+	Payload       json.RawMessage `json:"payload"`
+	// Key is the key of the message the envelope was decoded from.
+	Key string `json:"-"`
+}
+
+// New wraps the given payload in a new envelope of the given type and source.
+func New(eventType, source string, payload interface{}) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("an error occured while marshalling the event payload: %w", err)
+	}
+	return Envelope{
+		ID:            uuid.New().String(),
+		Type:          eventType,
+		OccurredAt:    time.Now(),
+		Source:        source,
+		SchemaVersion: SchemaVersion,
+		Payload:       data,
+	}, nil
+}
+
+// Decode decodes the envelope of the given message. Tombstones are decoded as deletions of the keyed entity, and
+// messages written before the envelope existed are decoded as envelopes of version 0, without ID nor type, whose
+// payload is the whole message, or its payload field for the legacy connector messages.
+func Decode(key, value []byte) (Envelope, error) {
+	if len(value) == 0 {
+		return Envelope{Type: FilmDeleted, Key: string(key)}, nil
+	}
+	envelope := Envelope{}
+	if err := json.NewDecoder(bytes.NewReader(value)).Decode(&envelope); err != nil {
+		return Envelope{}, fmt.Errorf("an error occured while decoding the event: %w", err)
+	}
+	envelope.Key = string(key)
+	if envelope.SchemaVersion == 0 {
+		if len(envelope.Payload) == 0 || bytes.Equal(envelope.Payload, []byte("null")) {
+			envelope.Payload = value
+		}
+		return Envelope{Payload: envelope.Payload, Key: string(key)}, nil
+	}
+	if envelope.SchemaVersion > SchemaVersion {
+		return Envelope{}, fmt.Errorf("the event %s has the unsupported schema version %d", envelope.ID, envelope.SchemaVersion)
+	}
+	return envelope, nil
+}
+
+// Unmarshal decodes the payload of the envelope into the given value.
+func (e Envelope) Unmarshal(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return fmt.Errorf("the event %s has no payload", e.ID)
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("an error occured while decoding the payload of the event %s: %w", e.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// defaultCheckTimeout bounds every check, so a dependency that hangs is reported as down instead of hanging the probe.
+const defaultCheckTimeout = 3 * time.Second
+
+// Check tells whether a dependency is healthy, returning why it is not otherwise.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the outcome of every check of a probe.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds the checks of the liveness and readiness probes of a service. Liveness checks tell whether the
+// service must be restarted, such as a stuck consumer, while readiness checks tell whether it is able to do its job,
+// such as whether its dependencies are reachable.
+type Checker struct {
+	mu        sync.RWMutex
+	liveness  []namedCheck
+	readiness []namedCheck
+	timeout   time.Duration
+}
+
+func NewChecker() *Checker {
+	return &Checker{timeout: defaultCheckTimeout}
+}
+
+// AddLiveness adds a check to the liveness probe.
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness = append(c.liveness, namedCheck{name: name, check: check})
+}
+
+// AddReadiness adds a check to the readiness probe.
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness = append(c.readiness, namedCheck{name: name, check: check})
+}
+
+// Liveness returns the handler of the liveness probe.
+func (c *Checker) Liveness() http.Handler {
+	return c.handler(func() []namedCheck {
+		return c.liveness
+	})
+}
+
+// Readiness returns the handler of the readiness probe.
+func (c *Checker) Readiness() http.Handler {
+	return c.handler(func() []namedCheck {
+		return c.readiness
+	})
+}
+
+// handler runs the given checks concurrently, answering 200 when all of them are up and 503 otherwise, along with
+// the result of each of them.
+func (c *Checker) handler(checks func() []namedCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		toRun := checks()
+		c.mu.RUnlock()
+		report := c.run(r.Context(), toRun)
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != StatusUp {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+func (c *Checker) run(ctx context.Context, checks []namedCheck) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	report := Report{Status: StatusUp, Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check namedCheck) {
+			defer wg.Done()
+			result := Result{Status: StatusUp}
+			if err := check.check(ctx); err != nil {
+				result = Result{Status: StatusDown, Error: err.Error()}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.name] = result
+			if result.Status != StatusUp {
+				report.Status = StatusDown
+			}
+		}(check)
+	}
+	wg.Wait()
+	return report
+}
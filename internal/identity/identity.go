@@ -0,0 +1,107 @@
+package identity
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"strings"
+	"time"
+)
+
+var ErrConflictingMapping = errors.New("the film is already mapped to another identity")
+
+const findByLegacyIDSQL = "select uuid, legacy_film_id from film_identities where legacy_film_id = ?"
+const findByLegacyIDsSQL = "select uuid, legacy_film_id from film_identities where legacy_film_id in (%s)"
+const findByUUIDSQL = "select uuid, legacy_film_id from film_identities where uuid = ?"
+const insertMappingSQL = "insert into film_identities (uuid, legacy_film_id, created_at) values (?, ?, ?)"
+const deleteMappingSQL = "delete from film_identities where uuid = ? and legacy_film_id = ?"
+
+const duplicateEntryErrorNumber = 1062
+
+// Mapping ties the UUID of a catalogue film to the ID of the same film in the legacy DB. Both synchronizers keep the
+// mappings they know of in the film_identities table of their own DB, so they find the film an event refers to by its
+// identity in their DB, whatever the identity the event carries.
+type Mapping struct {
+	UUID     string `json:"uuid"`
+	LegacyID int    `json:"legacy_film_id"`
+}
+
+// ByLegacyID returns the mapping of the given legacy film, telling whether there is one.
+func ByLegacyID(ctx context.Context, tx *sql.Tx, legacyID int) (Mapping, bool, error) {
+	return find(tx.QueryRowContext(ctx, findByLegacyIDSQL, legacyID))
+}
+
+// ByUUID returns the mapping of the given catalogue film, telling whether there is one.
+func ByUUID(ctx context.Context, tx *sql.Tx, filmUUID string) (Mapping, bool, error) {
+	return find(tx.QueryRowContext(ctx, findByUUIDSQL, filmUUID))
+}
+
+// ByLegacyIDs returns the mappings of the given legacy films, indexed by their legacy ID. Films that are not mapped
+// are missing.
+func ByLegacyIDs(ctx context.Context, tx *sql.Tx, legacyIDs []int) (map[int]Mapping, error) {
+	mappings := make(map[int]Mapping, len(legacyIDs))
+	if len(legacyIDs) == 0 {
+		return mappings, nil
+	}
+	args := make([]interface{}, 0, len(legacyIDs))
+	for _, id := range legacyIDs {
+		args = append(args, id)
+	}
+	query := fmt.Sprintf(findByLegacyIDsSQL, strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", "))
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while searching the film identities: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := Mapping{}
+		if err = rows.Scan(&m.UUID, &m.LegacyID); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the film identities: %w", err)
+		}
+		mappings[m.LegacyID] = m
+	}
+	return mappings, rows.Err()
+}
+
+// Map records the given mapping within the given transaction. Recording a mapping again is a no-op, but mapping
+// either film to another identity fails with ErrConflictingMapping.
+func Map(ctx context.Context, tx *sql.Tx, m Mapping) error {
+	_, err := tx.ExecContext(ctx, insertMappingSQL, m.UUID, m.LegacyID, time.Now())
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != duplicateEntryErrorNumber {
+		if err != nil {
+			return fmt.Errorf("an error occured while mapping the film %s: %w", m.UUID, err)
+		}
+		return nil
+	}
+	existing, ok, err := ByUUID(ctx, tx, m.UUID)
+	if err != nil {
+		return err
+	}
+	if !ok || existing != m {
+		return fmt.Errorf("%w: the film %s can not be mapped to the legacy film %d", ErrConflictingMapping, m.UUID, m.LegacyID)
+	}
+	return nil
+}
+
+// Unmap removes the given mapping within the given transaction, once either film is gone for good.
+func Unmap(ctx context.Context, tx *sql.Tx, m Mapping) error {
+	if _, err := tx.ExecContext(ctx, deleteMappingSQL, m.UUID, m.LegacyID); err != nil {
+		return fmt.Errorf("an error occured while unmapping the film %s: %w", m.UUID, err)
+	}
+	return nil
+}
+
+func find(row *sql.Row) (Mapping, bool, error) {
+	m := Mapping{}
+	err := row.Scan(&m.UUID, &m.LegacyID)
+	if err == sql.ErrNoRows {
+		return Mapping{}, false, nil
+	}
+	if err != nil {
+		return Mapping{}, false, fmt.Errorf("an error occured while searching the film identity: %w", err)
+	}
+	return m, true, nil
+}
@@ -0,0 +1,102 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ConsumeBatch fetches messages until the given context is done, processing them in batches of up to the configured
+// batch size, or of what was fetched within the configured batch wait since the first message of the batch. The
+// offsets of a batch are committed together once it is processed, even if the context is done meanwhile, so stopping
+// the consumer drains the batch being processed. A batch that still fails after the retries is
+// processed again one message at a time, so only the messages that fail on their own are sent to the dead-letter
+// topic.
+func (c *defaultClient) ConsumeBatch(ctx context.Context, batchFunc BatchFunc) error {
+	if c.reader == nil {
+		return fmt.Errorf("no reader was given")
+	}
+	if batchFunc == nil {
+		return fmt.Errorf("no batch function was given")
+	}
+	c.state.Store(consumerRunning)
+	defer c.state.Store(consumerStopped)
+	stats := newThroughput("batch", c.logger)
+	defer stats.stop()
+	for {
+		batch, err := c.fetchBatch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if !c.processBatch(ctx, batch, batchFunc) {
+			continue
+		}
+		// the context may be done by now, but the processed batch must still be committed
+		if err = c.reader.CommitMessages(context.Background(), batch...); err != nil {
+			c.logger.Error("could not commit the batch", "size", len(batch), "error", err)
+			continue
+		}
+		stats.add(len(batch))
+	}
+}
+
+// fetchBatch blocks until a message is fetched, then keeps fetching until the batch is full or the batch wait is over.
+func (c *defaultClient) fetchBatch(ctx context.Context) ([]kafka.Message, error) {
+	msg, err := c.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch := []kafka.Message{msg}
+	fetchCtx, cancel := context.WithTimeout(ctx, c.batchWait)
+	defer cancel()
+	for len(batch) < c.batchSize {
+		msg, err = c.fetch(fetchCtx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if fetchCtx.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+		batch = append(batch, msg)
+	}
+	return batch, nil
+}
+
+// processBatch processes the given batch, falling back to its messages one at a time when the batch fails, and tells
+// whether the offsets of the batch can be committed.
+func (c *defaultClient) processBatch(ctx context.Context, batch []kafka.Message, batchFunc BatchFunc) bool {
+	defer c.progress.start()()
+	first, last := batch[0], batch[len(batch)-1]
+	attrs := []any{"topic", first.Topic, "partition", first.Partition, "first_offset", first.Offset, "last_offset", last.Offset, "size", len(batch)}
+	msgs := make([]Message, 0, len(batch))
+	for _, msg := range batch {
+		msgs = append(msgs, newMessage(msg))
+	}
+	spanCtx, span := startBatchSpan(ctx, msgs)
+	_, err := c.retry(ctx, attrs, func() error {
+		return batchFunc(spanCtx, msgs)
+	})
+	endSpans([]trace.Span{span}, err)
+	if err == nil {
+		metrics.ObserveConsumed(first.Topic, metrics.ResultProcessed, len(batch))
+		return true
+	}
+	c.logger.Warn("the batch failed, processing its messages one at a time", append(attrs, "error", err)...)
+	readFunc := func(ctx context.Context, msg Message) error {
+		return batchFunc(ctx, []Message{msg})
+	}
+	for _, msg := range batch {
+		if !c.consume(ctx, msg, readFunc) {
+			return false
+		}
+	}
+	return true
+}
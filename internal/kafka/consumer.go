@@ -0,0 +1,182 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/metrics"
+	"github.com/segmentio/kafka-go"
+	"hash/fnv"
+	"sync"
+)
+
+// workerQueueSize is how many fetched messages each worker may have waiting, which bounds the messages in flight.
+const workerQueueSize = 64
+
+// Consume fetches messages until the given context is done, processing them with the given function in the configured
+// number of workers, along with the same retries and dead-lettering of Read. Once the context is done, it returns as
+// soon as the messages being processed are finished and committed. Messages with the same key, or without a
+// key in the same partition, are always processed by the same worker, in the order they were fetched. Offsets are
+// only committed up to the highest message of each partition whose predecessors were all processed, so a restart
+// never skips a message still being processed, at the cost of reprocessing some of the following ones.
+func (c *defaultClient) Consume(ctx context.Context, readFunc ReadFunc) error {
+	if c.reader == nil {
+		return fmt.Errorf("no reader was given")
+	}
+	if readFunc == nil {
+		return fmt.Errorf("no read function was given")
+	}
+	c.state.Store(consumerRunning)
+	defer c.state.Store(consumerStopped)
+	tracker := newOffsetTracker()
+	stats := newThroughput("message", c.logger)
+	defer stats.stop()
+	commits := make(chan kafka.Message, c.workers*workerQueueSize)
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		c.commitLoop(commits)
+	}()
+
+	var wg sync.WaitGroup
+	queues := make([]chan kafka.Message, c.workers)
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, workerQueueSize)
+		wg.Add(1)
+		go func(queue <-chan kafka.Message) {
+			defer wg.Done()
+			for msg := range queue {
+				// once stopped, only the messages being processed are drained, and the queued ones are left
+				// uncommitted to be redelivered
+				if ctx.Err() != nil {
+					continue
+				}
+				if !c.consume(ctx, msg, readFunc) {
+					continue
+				}
+				stats.add(1)
+				if commit, ok := tracker.done(msg); ok {
+					commits <- commit
+				}
+			}
+		}(queues[i])
+	}
+
+	var err error
+	for {
+		msg, fetchErr := c.fetch(ctx)
+		if fetchErr != nil {
+			if ctx.Err() == nil {
+				err = fetchErr
+			}
+			break
+		}
+		tracker.add(msg)
+		queues[workerOf(msg, len(queues))] <- msg
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	close(commits)
+	<-committed
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// consume processes the given message as Read does, telling whether its offset can be committed, which is not the
+// case when it could neither be processed nor sent to the dead-letter topic.
+func (c *defaultClient) consume(ctx context.Context, msg kafka.Message, readFunc ReadFunc) bool {
+	defer c.progress.start()()
+	attempts, readErr := c.process(ctx, msg, readFunc)
+	if readErr == nil {
+		metrics.ObserveConsumed(msg.Topic, metrics.ResultProcessed, 1)
+		return true
+	}
+	if err := c.deadLetter(ctx, msg, readErr, attempts); err != nil {
+		c.logger.Error("the message will be redelivered", append(messageAttrs(msg), "error", err)...)
+		metrics.ObserveConsumed(msg.Topic, metrics.ResultRedelivered, 1)
+		return false
+	}
+	metrics.ObserveConsumed(msg.Topic, metrics.ResultDeadLettered, 1)
+	c.logger.Error("the message was sent to the dead-letter topic", append(messageAttrs(msg), "attempts", attempts, "error", readErr)...)
+	return true
+}
+
+// commitLoop commits the given messages one at a time, skipping the ones behind an offset already committed.
+func (c *defaultClient) commitLoop(commits <-chan kafka.Message) {
+	last := make(map[int]int64)
+	for msg := range commits {
+		if offset, ok := last[msg.Partition]; ok && msg.Offset <= offset {
+			continue
+		}
+		// the context of the consumer may be already done, but what was processed must still be committed
+		if err := c.reader.CommitMessages(context.Background(), msg); err != nil {
+			c.logger.Error("could not commit the offset", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "error", err)
+			continue
+		}
+		last[msg.Partition] = msg.Offset
+	}
+}
+
+// workerOf returns the worker of the given message, hashing its key, or its partition when it has no key.
+func workerOf(msg kafka.Message, workers int) int {
+	h := fnv.New32a()
+	if len(msg.Key) > 0 {
+		_, _ = h.Write(msg.Key)
+	} else {
+		_, _ = fmt.Fprintf(h, "partition-%d", msg.Partition)
+	}
+	return int(h.Sum32() % uint32(workers))
+}
+
+// offsetTracker tracks the fetched messages of each partition until they are processed.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+// partitionOffsets holds the fetched messages of a partition in the order they were fetched, along with the offsets
+// already processed.
+type partitionOffsets struct {
+	pending   []kafka.Message
+	processed map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[int]*partitionOffsets)}
+}
+
+func (t *offsetTracker) add(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.partitions[msg.Partition]
+	if !ok {
+		p = &partitionOffsets{processed: make(map[int64]bool)}
+		t.partitions[msg.Partition] = p
+	}
+	p.pending = append(p.pending, msg)
+}
+
+// done marks the given message as processed, returning the highest message of its partition that can be committed,
+// if any.
+func (t *offsetTracker) done(msg kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.partitions[msg.Partition]
+	if !ok {
+		return kafka.Message{}, false
+	}
+	p.processed[msg.Offset] = true
+	var commit kafka.Message
+	advanced := false
+	for len(p.pending) > 0 && p.processed[p.pending[0].Offset] {
+		commit = p.pending[0]
+		delete(p.processed, commit.Offset)
+		p.pending = p.pending[1:]
+		advanced = true
+	}
+	return commit, advanced
+}
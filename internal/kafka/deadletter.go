@@ -0,0 +1,171 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/segmentio/kafka-go"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderReplayedFrom is set on replayed messages with the dead-letter offset they were replayed from.
+const HeaderReplayedFrom = "dlq-replayed-from"
+
+// deadLetterHeaderPrefix starts the headers added by the dead-lettering and the replay, which are not replayed.
+const deadLetterHeaderPrefix = "dlq-"
+
+// DeadLetter is a message parked in the dead-letter topic, along with the metadata of its failure.
+type DeadLetter struct {
+	Partition         int
+	Offset            int64
+	Key               []byte
+	Value             []byte
+	Topic             string
+	OriginalPartition int
+	OriginalOffset    int64
+	Error             string
+	Attempts          int
+	FailedAt          time.Time
+	// Headers are the headers of the original message, such as its request ID and trace context.
+	Headers map[string]string
+}
+
+// ReadDeadLetters reads every message currently parked in the dead-letter topic of the given configuration.
+func ReadDeadLetters(ctx context.Context, config configs.KafkaConfigurer) ([]DeadLetter, error) {
+	topic := config.DeadLetterTopic()
+	sec, err := newSecurity(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer := sec.dialer()
+	conn, err := dialer.DialContext(ctx, "tcp", config.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to Kafka: %w", err)
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	_ = conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the partitions of %s: %w", topic, err)
+	}
+	var letters []DeadLetter
+	for _, partition := range partitions {
+		partitionLetters, err := readDeadLetterPartition(ctx, dialer, config.Brokers(), topic, partition.ID)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, partitionLetters...)
+	}
+	return letters, nil
+}
+
+func readDeadLetterPartition(ctx context.Context, dialer *kafka.Dialer, brokers []string, topic string, partition int) ([]DeadLetter, error) {
+	conn, err := dialer.DialLeader(ctx, "tcp", brokers[0], topic, partition)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the leader of partition %d: %w", partition, err)
+	}
+	first, last, err := conn.ReadOffsets()
+	_ = conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the offsets of partition %d: %w", partition, err)
+	}
+	if first >= last {
+		return nil, nil
+	}
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   brokers,
+		Dialer:    dialer,
+		Topic:     topic,
+		Partition: partition,
+	})
+	defer reader.Close()
+	if err = reader.SetOffset(first); err != nil {
+		return nil, fmt.Errorf("could not seek partition %d: %w", partition, err)
+	}
+	var letters []DeadLetter
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("an error occured while reading partition %d: %w", partition, err)
+		}
+		letters = append(letters, newDeadLetter(msg))
+		if msg.Offset >= last-1 {
+			return letters, nil
+		}
+	}
+}
+
+func newDeadLetter(msg kafka.Message) DeadLetter {
+	letter := DeadLetter{
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+	}
+	for _, header := range msg.Headers {
+		value := string(header.Value)
+		switch header.Key {
+		case HeaderDeadLetterTopic:
+			letter.Topic = value
+		case HeaderDeadLetterPartition:
+			letter.OriginalPartition, _ = strconv.Atoi(value)
+		case HeaderDeadLetterOffset:
+			letter.OriginalOffset, _ = strconv.ParseInt(value, 10, 64)
+		case HeaderDeadLetterError:
+			letter.Error = value
+		case HeaderDeadLetterAttempts:
+			letter.Attempts, _ = strconv.Atoi(value)
+		case HeaderDeadLetterFailedAt:
+			letter.FailedAt, _ = time.Parse(time.RFC3339, value)
+		default:
+			if strings.HasPrefix(header.Key, deadLetterHeaderPrefix) {
+				continue
+			}
+			if letter.Headers == nil {
+				letter.Headers = make(map[string]string)
+			}
+			letter.Headers[header.Key] = value
+		}
+	}
+	return letter
+}
+
+// ReplayDeadLetters writes the original message of the given dead letters back onto the given topic, or onto the
+// topic each of them came from when no topic is given. The original headers are written back, so the request ID and
+// the trace of the message are kept.
+func ReplayDeadLetters(ctx context.Context, config configs.KafkaConfigurer, topic string, letters []DeadLetter) error {
+	sec, err := newSecurity(config)
+	if err != nil {
+		return err
+	}
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers()...),
+		Transport:    sec.transport(),
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+	msgs := make([]kafka.Message, 0, len(letters))
+	for _, letter := range letters {
+		target := topic
+		if target == "" {
+			target = letter.Topic
+		}
+		if target == "" {
+			return fmt.Errorf("the dead letter at offset %d of partition %d has no original topic", letter.Offset, letter.Partition)
+		}
+		headers := append(newHeaders(letter.Headers),
+			kafka.Header{Key: HeaderReplayedFrom, Value: []byte(fmt.Sprintf("%d/%d", letter.Partition, letter.Offset))})
+		msgs = append(msgs, kafka.Message{
+			Topic:   target,
+			Key:     letter.Key,
+			Value:   letter.Value,
+			Headers: headers,
+			Time:    time.Now(),
+		})
+	}
+	if err := writer.WriteMessages(ctx, msgs...); err != nil {
+		return fmt.Errorf("an error occured while replaying the dead letters: %w", err)
+	}
+	return nil
+}
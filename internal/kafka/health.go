@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Ping tells whether the brokers are reachable, fetching the metadata of the configured topic from the first one that
+// answers.
+func (c *defaultClient) Ping(ctx context.Context) error {
+	var err error
+	for _, broker := range c.brokers {
+		var partitionsErr error
+		conn, dialErr := c.dialer.DialContext(ctx, "tcp", broker)
+		if dialErr != nil {
+			err = dialErr
+			continue
+		}
+		_, partitionsErr = conn.ReadPartitions(c.topic)
+		_ = conn.Close()
+		if partitionsErr == nil {
+			return nil
+		}
+		err = partitionsErr
+	}
+	return fmt.Errorf("no Kafka broker is reachable: %w", err)
+}
+
+// Lifecycle of the consumer, tracked so a consumer that stopped on its own is reported.
+const (
+	consumerNotStarted int32 = iota
+	consumerRunning
+	consumerStopped
+)
+
+// CheckStalled tells whether a message, or a batch, has been processed for longer than the given threshold, which
+// means the consumer is stuck, or whether the consumer stopped. An idle consumer is never stalled.
+func (c *defaultClient) CheckStalled(threshold time.Duration) error {
+	if c.state.Load() == consumerStopped {
+		return fmt.Errorf("the consumer is not running")
+	}
+	if since, busy := c.progress.oldest(); busy && time.Since(since) > threshold {
+		return fmt.Errorf("a message has been processed for %s", time.Since(since).Round(time.Second))
+	}
+	return nil
+}
+
+// progress tracks when the messages being processed started.
+type progress struct {
+	mu      sync.Mutex
+	next    int64
+	started map[int64]time.Time
+}
+
+func newProgress() *progress {
+	return &progress{started: make(map[int64]time.Time)}
+}
+
+// start records that a message started being processed, returning the function to call once it is finished.
+func (p *progress) start() func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.next
+	p.next++
+	p.started[id] = time.Now()
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.started, id)
+	}
+}
+
+// oldest returns when the oldest message being processed started, if any.
+func (p *progress) oldest() (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var oldest time.Time
+	for _, started := range p.started {
+		if oldest.IsZero() || started.Before(oldest) {
+			oldest = started
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
@@ -2,91 +2,456 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/diegohordi/go-kafka/internal/metrics"
 	"github.com/segmentio/kafka-go"
-	"log"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-type ReadFunc func(key []byte, content []byte) error
+// Message is a raw message, whose nil Value stands for a tombstone. Topic, Partition and Offset tell where a read
+// message came from, and are ignored when writing.
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+}
+
+// ReadFunc processes a message. The given context carries the trace of the message and is not cancelled when the
+// consumer is stopped, so the message can be finished.
+type ReadFunc func(ctx context.Context, msg Message) error
+
+// CompletionFunc is called with the messages written asynchronously once Kafka acknowledged them, or with the error
+// that made them fail.
+type CompletionFunc func(msgs []Message, err error)
+
+// BatchFunc processes a batch of messages at once, so either all of them are processed or none is.
+type BatchFunc func(ctx context.Context, msgs []Message) error
 
 type Reader interface {
-	Read(ctx context.Context, readFunc ReadFunc) (err error)
+	Consume(ctx context.Context, readFunc ReadFunc) error
+	ConsumeBatch(ctx context.Context, batchFunc BatchFunc) error
 }
 
 type Writer interface {
-	Write(ctx context.Context, msg interface{}) error
+	WriteMessages(ctx context.Context, msgs ...Message) error
 }
 
 type Client interface {
 	Close()
+	Ping(ctx context.Context) error
+	CheckStalled(threshold time.Duration) error
 	Reader
 	Writer
 }
 
+// Headers of the messages sent to the dead-letter topic, describing where the message came from and why it failed.
+const (
+	HeaderDeadLetterTopic     = "dlq-topic"
+	HeaderDeadLetterPartition = "dlq-partition"
+	HeaderDeadLetterOffset    = "dlq-offset"
+	HeaderDeadLetterError     = "dlq-error"
+	HeaderDeadLetterAttempts  = "dlq-attempts"
+	HeaderDeadLetterFailedAt  = "dlq-failed-at"
+)
+
+// HeaderRequestID carries the ID of the request that caused the message, so every log line of its journey can be
+// correlated.
+const HeaderRequestID = "request-id"
+
+// HeaderRepair marks the corrective messages written by the reconciliation, which are applied over the local rows
+// without going through the conflict resolution.
+const HeaderRepair = "repair"
+
 type defaultClient struct {
-	reader *kafka.Reader
-	writer *kafka.Writer
+	reader           *kafka.Reader
+	writer           *kafka.Writer
+	deadLetterWriter *kafka.Writer
+	maxAttempts      int
+	retryBackoff     time.Duration
+	maxRetryBackoff  time.Duration
+	workers          int
+	batchSize        int
+	batchWait        time.Duration
+	completion       CompletionFunc
+	brokers          []string
+	topic            string
+	dialer           *kafka.Dialer
+	progress         *progress
+	state            atomic.Int32
+	logger           *slog.Logger
+}
+
+// Option customizes a client created by NewClient.
+type Option func(c *defaultClient)
+
+// WithCompletion sets the function called with the outcome of the asynchronous writes, which is required to know
+// whether they succeeded when the writer is configured as asynchronous.
+func WithCompletion(completion CompletionFunc) Option {
+	return func(c *defaultClient) {
+		c.completion = completion
+	}
+}
+
+// WithLogger sets the logger of the client, which is the default logger otherwise.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *defaultClient) {
+		c.logger = logger
+	}
 }
 
-func NewClient(config configs.KafkaConfigurer, groupName string) Client {
+// NewClient creates a client that reads the configured topic as a member of the given consumer group, unless a group
+// ID is configured. Both reads and writes are secured by the configured TLS and SASL settings, and writes are batched
+// and compressed as configured.
+func NewClient(config configs.KafkaConfigurer, groupName string, opts ...Option) (Client, error) {
+	if config.GroupID() != "" {
+		groupName = config.GroupID()
+	}
+	sec, err := newSecurity(config)
+	if err != nil {
+		return nil, err
+	}
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   []string{config.DSN()},
-		Topic:     config.Topic(),
-		GroupID:   groupName,
-		Partition: 0,
+		Brokers: config.Brokers(),
+		Topic:   config.Topic(),
+		GroupID: groupName,
+		Dialer:  sec.dialer(),
 	})
 	writer := &kafka.Writer{
-		Addr:         kafka.TCP(config.DSN()),
+		Addr:         kafka.TCP(config.Brokers()...),
+		Transport:    sec.transport(),
 		Topic:        config.Topic(),
+		Balancer:     newBalancer(config.Balancer()),
+		RequiredAcks: kafka.RequireAll,
+		WriteTimeout: config.WriteTimeout(),
+		BatchSize:    config.WriterBatchSize(),
+		BatchTimeout: config.WriterLinger(),
+		Compression:  newCompression(config.WriterCompression()),
+		Async:        config.WriterAsync(),
+	}
+	deadLetterWriter := &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers()...),
+		Topic:        config.DeadLetterTopic(),
+		Transport:    sec.transport(),
 		RequiredAcks: kafka.RequireAll,
+		WriteTimeout: config.WriteTimeout(),
+	}
+	client := &defaultClient{
+		reader:           reader,
+		writer:           writer,
+		deadLetterWriter: deadLetterWriter,
+		maxAttempts:      config.MaxAttempts(),
+		retryBackoff:     config.RetryBackoff(),
+		maxRetryBackoff:  config.MaxRetryBackoff(),
+		workers:          config.Workers(),
+		batchSize:        config.ConsumerBatchSize(),
+		batchWait:        config.ConsumerBatchWait(),
+		brokers:          config.Brokers(),
+		topic:            config.Topic(),
+		dialer:           sec.dialer(),
+		progress:         newProgress(),
+		logger:           slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	if writer.Async {
+		if client.completion == nil {
+			return nil, fmt.Errorf("an asynchronous writer requires a completion function")
+		}
+		writer.Completion = func(msgs []kafka.Message, err error) {
+			metrics.ObserveProduced(writer.Topic, len(msgs), err)
+			completed := make([]Message, 0, len(msgs))
+			for _, msg := range msgs {
+				completed = append(completed, newMessage(msg))
+			}
+			client.completion(completed, err)
+		}
+	}
+	return client, nil
+}
+
+// WriteCloser writes to a single topic.
+type WriteCloser interface {
+	Writer
+	Close()
+}
+
+// NewWriter creates a client that only writes to the given topic, secured, batched and compressed as configured, for
+// the tools that write onto other topics than the configured one. Writes are always synchronous, so their outcome is
+// returned.
+func NewWriter(config configs.KafkaConfigurer, topic string, opts ...Option) (WriteCloser, error) {
+	sec, err := newSecurity(config)
+	if err != nil {
+		return nil, err
+	}
+	client := &defaultClient{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(config.Brokers()...),
+			Transport:    sec.transport(),
+			Topic:        topic,
+			Balancer:     newBalancer(config.Balancer()),
+			RequiredAcks: kafka.RequireAll,
+			WriteTimeout: config.WriteTimeout(),
+			BatchSize:    config.WriterBatchSize(),
+			BatchTimeout: config.WriterLinger(),
+			Compression:  newCompression(config.WriterCompression()),
+		},
+		brokers: config.Brokers(),
+		topic:   topic,
+		dialer:  sec.dialer(),
+		logger:  slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client, nil
+}
+
+// newCompression returns the compression codec with the given name, where none means no compression.
+func newCompression(name string) kafka.Compression {
+	switch name {
+	case configs.CompressionGzip:
+		return kafka.Gzip
+	case configs.CompressionSnappy:
+		return kafka.Snappy
+	case configs.CompressionLz4:
+		return kafka.Lz4
+	case configs.CompressionZstd:
+		return kafka.Zstd
+	default:
+		return 0
 	}
-	return &defaultClient{reader: reader, writer: writer}
 }
 
+// newBalancer creates the balancer with the given name. Every balancer but round robin and least bytes sends the
+// messages with the same key to the same partition, so they are consumed in the order they were written.
+func newBalancer(name string) kafka.Balancer {
+	switch name {
+	case configs.BalancerHash:
+		return &kafka.Hash{}
+	case configs.BalancerCRC32:
+		return kafka.CRC32Balancer{}
+	case configs.BalancerRoundRobin:
+		return &kafka.RoundRobin{}
+	case configs.BalancerLeastBytes:
+		return &kafka.LeastBytes{}
+	default:
+		return kafka.Murmur2Balancer{}
+	}
+}
+
+// Close closes the reader, which leaves the consumer group, and the writers, which flush the buffered messages and
+// wait for their completion, so nothing written before is lost.
 func (c *defaultClient) Close() {
-	if c.reader == nil {
-		return
+	if c.reader != nil {
+		if err := c.reader.Close(); err != nil {
+			c.logger.Error("could not close the Kafka reader", "error", err)
+		}
 	}
-	if err := c.reader.Close(); err != nil {
-		log.Printf("could not close Kafka connection %v\n", err)
+	if c.writer != nil {
+		if err := c.writer.Close(); err != nil {
+			c.logger.Error("could not close the Kafka writer", "error", err)
+		}
 	}
-	log.Println("Kafka connection released successfully")
+	if c.deadLetterWriter != nil {
+		if err := c.deadLetterWriter.Close(); err != nil {
+			c.logger.Error("could not close the Kafka dead-letter writer", "error", err)
+		}
+	}
+	c.logger.Info("Kafka connection released successfully")
 }
 
-func (c *defaultClient) Read(ctx context.Context, readFunc ReadFunc) (err error) {
-	if c.reader == nil {
-		return fmt.Errorf("no reader was given")
+// fetch fetches the next message, recording how far behind the end of its partition it is. Failed fetches are retried
+// with a backoff until the context is done, so the consumer outlives the brokers being unreachable, unless the reader
+// was closed.
+func (c *defaultClient) fetch(ctx context.Context) (kafka.Message, error) {
+	for attempt := 1; ; attempt++ {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err == nil {
+			metrics.ObserveLag(msg.Topic, msg.Partition, msg.HighWaterMark-msg.Offset-1)
+			return msg, nil
+		}
+		if ctx.Err() != nil || errors.Is(err, io.EOF) {
+			return kafka.Message{}, fmt.Errorf("an error occured while fetching the message: %w", err)
+		}
+		backoff := c.backoff(attempt)
+		c.logger.Warn("could not fetch the message", "topic", c.topic, "attempt", attempt, "retry_in", backoff, "error", err)
+		if sleepErr := sleep(ctx, backoff); sleepErr != nil {
+			return kafka.Message{}, fmt.Errorf("an error occured while fetching the message: %w", err)
+		}
 	}
-	msg, err := c.reader.FetchMessage(ctx)
-	if err != nil {
-		return fmt.Errorf("an error occured while fetching the message: %w", err)
+}
+
+// process runs the given function until it succeeds or the attempts are exhausted, returning how many attempts were
+// made. The processing is traced as a span of the trace of the message.
+func (c *defaultClient) process(ctx context.Context, msg kafka.Message, readFunc ReadFunc) (int, error) {
+	m := newMessage(msg)
+	spanCtx, span := startProcessSpan(ctx, m)
+	attempts, err := c.retry(ctx, messageAttrs(msg), func() error {
+		return readFunc(spanCtx, m)
+	})
+	endSpans([]trace.Span{span}, err)
+	return attempts, err
+}
+
+// retry runs the given function until it succeeds or the attempts are exhausted, returning how many attempts were
+// made. The given attributes describe what is processed in the logs.
+func (c *defaultClient) retry(ctx context.Context, attrs []any, fn func() error) (int, error) {
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		if err = fn(); err == nil {
+			return attempt, nil
+		}
+		if attempt >= c.maxAttempts {
+			return attempt, err
+		}
+		c.logger.Warn("processing attempt failed", append(attrs, "attempt", attempt, "error", err)...)
+		if sleepErr := sleep(ctx, c.backoff(attempt)); sleepErr != nil {
+			return attempt, err
+		}
+	}
+}
+
+// messageAttrs returns the attributes logged along with the given message, including the ID of the request that
+// caused it, if any.
+func messageAttrs(msg kafka.Message) []any {
+	attrs := []any{"topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset}
+	for _, header := range msg.Headers {
+		if header.Key == HeaderRequestID {
+			attrs = append(attrs, "request_id", string(header.Value))
+		}
 	}
-	defer func(reader *kafka.Reader, ctx context.Context, msg kafka.Message) {
-		if err != nil {
-			return
+	return attrs
+}
+
+func newHeaders(headers map[string]string) []kafka.Header {
+	kafkaHeaders := make([]kafka.Header, 0, len(headers))
+	for key, value := range headers {
+		kafkaHeaders = append(kafkaHeaders, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return kafkaHeaders
+}
+
+func newMessage(msg kafka.Message) Message {
+	var headers map[string]string
+	if len(msg.Headers) > 0 {
+		headers = make(map[string]string, len(msg.Headers))
+		for _, header := range msg.Headers {
+			headers[header.Key] = string(header.Value)
 		}
-		err = reader.CommitMessages(ctx, msg)
-	}(c.reader, ctx, msg)
-	if readFunc == nil {
+	}
+	return Message{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   headers,
+	}
+}
+
+// deadLetter sends the given message to the dead-letter topic, along with the error metadata, until it succeeds or
+// the context is done. Once the consumer is stopped, the backoff of the retries is cut short, so a message that failed
+// while draining is left to be redelivered instead of being dead-lettered without all of its attempts.
+func (c *defaultClient) deadLetter(ctx context.Context, msg kafka.Message, readErr error, attempts int) error {
+	if c.deadLetterWriter == nil {
+		return fmt.Errorf("no dead-letter writer was given")
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("the consumer was stopped before the message was sent to the dead-letter topic: %w", readErr)
+	}
+	headers := append(append([]kafka.Header{}, msg.Headers...),
+		kafka.Header{Key: HeaderDeadLetterTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderDeadLetterPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderDeadLetterOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderDeadLetterError, Value: []byte(readErr.Error())},
+		kafka.Header{Key: HeaderDeadLetterAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderDeadLetterFailedAt, Value: []byte(time.Now().Format(time.RFC3339))},
+	)
+	deadLetterMsg := kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+		Time:    time.Now(),
+	}
+	for attempt := 1; ; attempt++ {
+		// the write itself is never cancelled, since a cancelled write may still be delivered while reported as failed,
+		// leaving the message both dead-lettered and redelivered
+		err := c.deadLetterWriter.WriteMessages(context.WithoutCancel(ctx), deadLetterMsg)
+		metrics.ObserveProduced(c.deadLetterWriter.Topic, 1, err)
+		if err == nil {
+			return nil
+		}
+		c.logger.Error("could not send the message to the dead-letter topic", append(messageAttrs(msg), "error", err)...)
+		if sleepErr := sleep(ctx, c.backoff(attempt)); sleepErr != nil {
+			return fmt.Errorf("an error occured while sending the message to the dead-letter topic: %w", err)
+		}
+	}
+}
+
+// backoff returns how long to wait after the given attempt.
+func (c *defaultClient) backoff(attempt int) time.Duration {
+	backoff := c.retryBackoff
+	for i := 1; i < attempt && backoff < c.maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.maxRetryBackoff {
+		return c.maxRetryBackoff
+	}
+	return backoff
+}
+
+// sleep waits for the given duration, unless the context is done before.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
 		return nil
 	}
-	err = readFunc(msg.Key, msg.Value)
-	return
 }
 
-func (c *defaultClient) Write(ctx context.Context, msg interface{}) error {
+// WriteMessages writes the given raw messages as a single batch, preserving their order. When the writer is
+// asynchronous, it returns as soon as the messages are buffered, and their outcome is reported to the completion
+// function.
+func (c *defaultClient) WriteMessages(ctx context.Context, msgs ...Message) error {
 	if c.writer == nil {
 		return fmt.Errorf("no writer was given")
 	}
-	mb, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("an error occured while marshalling the message: %w", err)
+	now := time.Now()
+	kafkaMsgs := make([]kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		kafkaMsgs = append(kafkaMsgs, kafka.Message{
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: newHeaders(msg.Headers),
+			Time:    now,
+		})
 	}
-	return c.writer.WriteMessages(ctx, kafka.Message{
-		Value: mb,
-		Time:  time.Now(),
-	})
+	return c.write(ctx, kafkaMsgs...)
+}
+
+// write writes the given messages, recording them as produced unless the writer is asynchronous, whose messages are
+// recorded once completed. Each message is traced, and its trace context is propagated through its headers.
+func (c *defaultClient) write(ctx context.Context, msgs ...kafka.Message) error {
+	spans := startPublishSpans(ctx, c.writer.Topic, msgs)
+	err := c.writer.WriteMessages(ctx, msgs...)
+	endSpans(spans, err)
+	if !c.writer.Async {
+		metrics.ObserveProduced(c.writer.Topic, len(msgs), err)
+	}
+	return err
 }
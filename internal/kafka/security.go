@@ -0,0 +1,105 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"os"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// security holds the TLS and SASL settings shared by the dialer of the readers and the transport of the writers.
+type security struct {
+	tls  *tls.Config
+	sasl sasl.Mechanism
+}
+
+func newSecurity(config configs.KafkaConfigurer) (security, error) {
+	tlsConfig, err := newTLSConfig(config.TLS())
+	if err != nil {
+		return security{}, err
+	}
+	mechanism, err := newSASLMechanism(config.SASL())
+	if err != nil {
+		return security{}, err
+	}
+	return security{tls: tlsConfig, sasl: mechanism}, nil
+}
+
+func (s security) dialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		Timeout:       dialTimeout,
+		DualStack:     true,
+		TLS:           s.tls,
+		SASLMechanism: s.sasl,
+	}
+}
+
+func (s security) transport() *kafka.Transport {
+	return &kafka.Transport{
+		DialTimeout: dialTimeout,
+		TLS:         s.tls,
+		SASL:        s.sasl,
+	}
+}
+
+// newTLSConfig creates the TLS config of the connections to the brokers, or nil when TLS is disabled.
+func newTLSConfig(config configs.TLSConfigurer) (*tls.Config, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify(),
+	}
+	if config.CAFile() != "" {
+		ca, err := os.ReadFile(config.CAFile())
+		if err != nil {
+			return nil, fmt.Errorf("could not read the Kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("the Kafka CA file %s has no PEM certificate", config.CAFile())
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile() != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile(), config.KeyFile())
+		if err != nil {
+			return nil, fmt.Errorf("could not load the Kafka client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newSASLMechanism creates the configured SASL mechanism, or nil when no authentication is configured.
+func newSASLMechanism(config configs.SASLConfigurer) (sasl.Mechanism, error) {
+	switch config.Mechanism() {
+	case "":
+		return nil, nil
+	case configs.SASLPlain:
+		return plain.Mechanism{Username: config.Username(), Password: config.Password()}, nil
+	case configs.SASLScramSHA256:
+		return newScramMechanism(scram.SHA256, config)
+	case configs.SASLScramSHA512:
+		return newScramMechanism(scram.SHA512, config)
+	default:
+		return nil, fmt.Errorf("the SASL mechanism %s is not supported", config.Mechanism())
+	}
+}
+
+func newScramMechanism(algorithm scram.Algorithm, config configs.SASLConfigurer) (sasl.Mechanism, error) {
+	mechanism, err := scram.Mechanism(algorithm, config.Username(), config.Password())
+	if err != nil {
+		return nil, fmt.Errorf("could not create the %s mechanism: %w", algorithm.Name(), err)
+	}
+	return mechanism, nil
+}
@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const throughputInterval = 30 * time.Second
+
+// throughput counts the messages processed by a consumer, logging its rate at every interval, so the per-message and
+// the batch modes can be compared.
+type throughput struct {
+	mode   string
+	count  int64
+	done   chan struct{}
+	logger *slog.Logger
+}
+
+func newThroughput(mode string, logger *slog.Logger) *throughput {
+	t := &throughput{mode: mode, done: make(chan struct{}), logger: logger}
+	go t.report()
+	return t
+}
+
+func (t *throughput) add(n int) {
+	atomic.AddInt64(&t.count, int64(n))
+}
+
+func (t *throughput) report() {
+	ticker := time.NewTicker(throughputInterval)
+	defer ticker.Stop()
+	since := time.Now()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			if count := atomic.SwapInt64(&t.count, 0); count > 0 {
+				t.logger.Info("messages consumed", "count", count, "mode", t.mode, "rate", float64(count)/now.Sub(since).Seconds())
+			}
+			since = now
+		}
+	}
+}
+
+func (t *throughput) stop() {
+	close(t.done)
+}
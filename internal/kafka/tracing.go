@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"context"
+	"github.com/diegohordi/go-kafka/internal/tracing"
+	"github.com/segmentio/kafka-go"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const messagingSystem = "kafka"
+
+// startProcessSpan starts the span of the processing of the given message, continuing the trace carried by its
+// headers. The returned context is not cancelled along with the given one, so a message being processed when the
+// consumer is stopped is still finished.
+func startProcessSpan(ctx context.Context, msg Message) (context.Context, trace.Span) {
+	ctx = tracing.Extract(context.WithoutCancel(ctx), msg.Headers)
+	return tracing.Tracer().Start(ctx, msg.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystem(messagingSystem),
+			semconv.MessagingOperationProcess,
+			semconv.MessagingDestinationName(msg.Topic),
+			semconv.MessagingKafkaDestinationPartition(msg.Partition),
+			semconv.MessagingKafkaMessageOffset(int(msg.Offset)),
+			semconv.MessagingKafkaMessageKey(string(msg.Key)),
+		),
+	)
+}
+
+// startBatchSpan starts the span of the processing of the given batch, which is linked to the trace of each of its
+// messages, since they may belong to different traces.
+func startBatchSpan(ctx context.Context, msgs []Message) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(msgs))
+	for _, msg := range msgs {
+		msgCtx := tracing.Extract(context.Background(), msg.Headers)
+		if spanCtx := trace.SpanContextFromContext(msgCtx); spanCtx.IsValid() {
+			links = append(links, trace.Link{SpanContext: spanCtx})
+		}
+	}
+	return tracing.Tracer().Start(context.WithoutCancel(ctx), msgs[0].Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			semconv.MessagingSystem(messagingSystem),
+			semconv.MessagingOperationProcess,
+			semconv.MessagingDestinationName(msgs[0].Topic),
+			semconv.MessagingBatchMessageCount(len(msgs)),
+		),
+	)
+}
+
+// startPublishSpans starts the span of the publishing of each of the given messages, continuing the trace carried by
+// its headers, such as the trace of the request that stored it in the outbox, or the trace of the given context
+// otherwise. The context of each span is injected into the headers of its message, so the consumers continue the trace.
+func startPublishSpans(ctx context.Context, topic string, msgs []kafka.Message) []trace.Span {
+	spans := make([]trace.Span, 0, len(msgs))
+	for i := range msgs {
+		headers := newMessage(msgs[i]).Headers
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		spanCtx, span := tracing.Tracer().Start(tracing.Extract(ctx, headers), topic+" publish",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				semconv.MessagingSystem(messagingSystem),
+				semconv.MessagingOperationPublish,
+				semconv.MessagingDestinationName(topic),
+				semconv.MessagingKafkaMessageKey(string(msgs[i].Key)),
+			),
+		)
+		tracing.Inject(spanCtx, headers)
+		msgs[i].Headers = newHeaders(headers)
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// endSpans ends the given spans, recording the given error on each of them, if any.
+func endSpans(spans []trace.Span, err error) {
+	for _, span := range spans {
+		tracing.Fail(span, err)
+		span.End()
+	}
+}
@@ -0,0 +1,118 @@
+package legacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/origin"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Year is the release year of a film, published by the connector as the first day of the year.
+type Year int
+
+func (y *Year) UnmarshalJSON(i []byte) error {
+	value := strings.Trim(string(i), `"`)
+	if value == "" {
+		return nil
+	}
+	time, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return err
+	}
+	*y = Year(time.Year())
+	return nil
+}
+
+func (y Year) MarshalJSON() ([]byte, error) {
+	if y == 0 {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(fmt.Sprintf("%04d-01-01", int(y)))
+}
+
+// Timestamp is a time published by the connector as milliseconds since the epoch.
+type Timestamp struct {
+	time.Time
+}
+
+func (t *Timestamp) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *Timestamp) UnmarshalJSON(i []byte) error {
+	value := strings.Trim(string(i), `"`)
+	if value == "" {
+		return nil
+	}
+	millis, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	time := time.UnixMilli(int64(millis))
+	if err != nil {
+		return err
+	}
+	t.Time = time
+	return nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(t.UnixMilli(), 10)), nil
+}
+
+// Film is a row of the legacy film table, as published by the connector.
+type Film struct {
+	FilmID      int        `json:"film_id"`
+	Title       string     `json:"title"`
+	ReleaseYear Year       `json:"release_year"`
+	LastUpdate  Timestamp  `json:"last_update"`
+	UUID        string     `json:"uuid"`
+	DeletedAt   *Timestamp `json:"deleted_at"`
+	SyncOrigin  string     `json:"sync_origin"`
+	SyncHash    string     `json:"sync_hash"`
+}
+
+// Hash returns the hash of the film content.
+func (f *Film) Hash() string {
+	return origin.Hash(f.Title, int(f.ReleaseYear))
+}
+
+// IsEcho tells whether the legacy row still holds exactly what the catalogue synced to it, so the event was triggered
+// by the write of the legacy synchronizer itself.
+func (f *Film) IsEcho() bool {
+	return f.SyncOrigin == origin.Catalogue && f.SyncHash == f.Hash()
+}
+
+// envelope is the layout of the connector messages, whose schema is not needed.
+type envelope struct {
+	Payload *Film `json:"payload"`
+}
+
+// Decode decodes the film of a connector message.
+func Decode(msg kafka.Message) (*Film, error) {
+	payload := &envelope{}
+	if err := json.NewDecoder(bytes.NewReader(msg.Value)).Decode(payload); err != nil {
+		return nil, err
+	}
+	if payload.Payload == nil {
+		return nil, fmt.Errorf("the message at offset %d of partition %d has no film", msg.Offset, msg.Partition)
+	}
+	return payload.Payload, nil
+}
+
+// Encode encodes the given film as a connector message, keyed by its film ID as the connector does, so it is consumed
+// like the changes published by the connector.
+func Encode(film *Film) (kafka.Message, error) {
+	value, err := json.Marshal(envelope{Payload: film})
+	if err != nil {
+		return kafka.Message{}, fmt.Errorf("an error occured while encoding the film %d: %w", film.FilmID, err)
+	}
+	return kafka.Message{Key: []byte(strconv.Itoa(film.FilmID)), Value: value}, nil
+}
@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/configs"
+	"github.com/go-chi/chi/v5/middleware"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// RequestIDKey is the attribute of the request ID in every log line, from the HTTP request through the Kafka event to
+// the write in the legacy DB.
+const RequestIDKey = "request_id"
+
+type requestIDContextKey struct{}
+
+// New creates a JSON logger of the given level, writing to the standard output. It also becomes the default logger,
+// so what is still written through the log package is structured as well.
+func New(level string) (*slog.Logger, error) {
+	var slogLevel slog.Level
+	switch strings.ToLower(level) {
+	case configs.LogLevelDebug:
+		slogLevel = slog.LevelDebug
+	case configs.LogLevelInfo, "":
+		slogLevel = slog.LevelInfo
+	case configs.LogLevelWarn:
+		slogLevel = slog.LevelWarn
+	case configs.LogLevelError:
+		slogLevel = slog.LevelError
+	default:
+		return nil, fmt.Errorf("the log level %s is unknown", level)
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slogLevel}))
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// WithRequestID returns a copy of the given context carrying the given request ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestID returns the request ID carried by the given context, either set by WithRequestID or by the request ID
+// middleware of chi.
+func RequestID(ctx context.Context) string {
+	if requestID, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		return requestID
+	}
+	return middleware.GetReqID(ctx)
+}
+
+// Middleware logs every request along with its request ID, so it must run after the request ID middleware of chi.
+func Middleware(logger *slog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			logger.Info("request served",
+				RequestIDKey, RequestID(r.Context()),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", ww.Status(),
+				"bytes", ww.BytesWritten(),
+				"duration", time.Since(start),
+				"remote_addr", r.RemoteAddr,
+			)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/origin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Results of the consumed messages.
+const (
+	ResultProcessed    = "processed"
+	ResultDeadLettered = "dead_lettered"
+	ResultRedelivered  = "redelivered"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	kafkaConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_messages_consumed_total",
+		Help: "Kafka messages consumed by topic and result.",
+	}, []string{"topic", "result"})
+
+	kafkaProduced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_messages_produced_total",
+		Help: "Kafka messages produced by topic.",
+	}, []string{"topic"})
+
+	kafkaProduceFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_messages_produce_failed_total",
+		Help: "Kafka messages that could not be produced by topic.",
+	}, []string{"topic"})
+
+	kafkaConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_consumer_lag",
+		Help: "Messages behind the end of each partition as of the last fetched message.",
+	}, []string{"topic", "partition"})
+
+	dbTransactionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_transaction_duration_seconds",
+		Help:    "DB transaction latency by outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "DB call latency by driver method, such as sql.conn.query, sql.conn.exec or sql.tx.commit, and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "status"})
+
+	syncDelay = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sync_delay_seconds",
+		Help:    "Delay between a change in the source DB and its apply in the target DB, by origin of the change.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"origin"})
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "sync_suppressed_echoes_total",
+		Help: "Events dropped for being echoes of the writes of the synchronizers themselves.",
+	}, func() float64 {
+		return float64(origin.SuppressedEchoes())
+	})
+)
+
+// ObserveHTTPRequest records a served HTTP request.
+func ObserveHTTPRequest(method, route string, status int, elapsed time.Duration) {
+	httpRequests.WithLabelValues(method, route, fmt.Sprint(status)).Inc()
+	httpRequestDuration.WithLabelValues(method, route).Observe(elapsed.Seconds())
+}
+
+// ObserveConsumed records a consumed message of the given topic along with its result.
+func ObserveConsumed(topic, result string, n int) {
+	kafkaConsumed.WithLabelValues(topic, result).Add(float64(n))
+}
+
+// ObserveProduced records messages produced to the given topic, or that failed to be when err is not nil.
+func ObserveProduced(topic string, n int, err error) {
+	if err != nil {
+		kafkaProduceFailures.WithLabelValues(topic).Add(float64(n))
+		return
+	}
+	kafkaProduced.WithLabelValues(topic).Add(float64(n))
+}
+
+// ObserveLag records how many messages the consumer of the given partition is behind.
+func ObserveLag(topic string, partition int, lag int64) {
+	if lag < 0 {
+		lag = 0
+	}
+	kafkaConsumerLag.WithLabelValues(topic, fmt.Sprint(partition)).Set(float64(lag))
+}
+
+// ObserveTransaction records a DB transaction that took the given time.
+func ObserveTransaction(committed bool, elapsed time.Duration) {
+	outcome := "commit"
+	if !committed {
+		outcome = "rollback"
+	}
+	dbTransactionDuration.WithLabelValues(outcome).Observe(elapsed.Seconds())
+}
+
+// ObserveQuery records a call to the DB driver of the given method that took the given time.
+func ObserveQuery(method, status string, elapsed time.Duration) {
+	dbQueryDuration.WithLabelValues(method, status).Observe(elapsed.Seconds())
+}
+
+// ObserveSyncDelay records the delay between the given change of the source DB and now, when it was applied.
+func ObserveSyncDelay(changeOrigin string, changedAt time.Time) {
+	if changedAt.IsZero() {
+		return
+	}
+	syncDelay.WithLabelValues(changeOrigin).Observe(time.Since(changedAt).Seconds())
+}
+
+// Handler returns the handler exposing the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve exposes the metrics at /metrics on the given port, along with the given handlers by their path, for the
+// services that have no HTTP server of their own. The returned server must be shut down along with the service.
+func Serve(port int, handlers map[string]http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("could not serve the metrics: %v\n", err)
+		}
+	}()
+	return srv
+}
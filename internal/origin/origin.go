@@ -0,0 +1,35 @@
+package origin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+)
+
+// Catalogue marks the changes made through the catalogue REST API.
+const Catalogue = "catalogue"
+
+// Legacy marks the changes made directly in the legacy DB.
+const Legacy = "legacy"
+
+var suppressedEchoes = expvar.NewInt("sync_suppressed_echoes")
+
+// Hash returns the hash of the synced film content, used to tell whether an event carries anything new compared to
+// the row it targets.
+func Hash(title string, year int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", title, year)))
+	return hex.EncodeToString(sum[:])
+}
+
+// SuppressEcho counts an event dropped for being an echo of a write made by the synchronizers themselves, returning
+// how many echoes were suppressed so far.
+func SuppressEcho() int64 {
+	suppressedEchoes.Add(1)
+	return suppressedEchoes.Value()
+}
+
+// SuppressedEchoes returns how many echoes were suppressed so far.
+func SuppressedEchoes() int64 {
+	return suppressedEchoes.Value()
+}
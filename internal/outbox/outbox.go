@@ -0,0 +1,263 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/diegohordi/go-kafka/internal/database"
+	"github.com/diegohordi/go-kafka/internal/kafka"
+	"github.com/diegohordi/go-kafka/internal/logging"
+	"github.com/diegohordi/go-kafka/internal/tracing"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const insertMessageSQL = "insert into outbox (aggregate_id, payload, request_id, trace_context, created_at) values (?, ?, ?, ?, ?)"
+const getPendingMessagesSQL = "select id, aggregate_id, payload, request_id, trace_context from outbox where sent_at is null and id > ? order by id limit ? for update"
+const markMessageAsSentSQL = "update outbox set sent_at = ? where id = ?"
+const markMessagesAsSentSQL = "update outbox set sent_at = ? where id in (%s)"
+
+// HeaderOutboxID is set on the published messages with the ID of their outbox row, so the asynchronous writes can be
+// matched to the rows once acknowledged.
+const HeaderOutboxID = "outbox-id"
+
+const defaultPollInterval = 500 * time.Millisecond
+const defaultBatchSize = 100
+const defaultRelayTimeout = 30 * time.Second
+
+type message struct {
+	id          int64
+	aggregateID string
+	payload     []byte
+	requestID   sql.NullString
+	// traceContext holds the headers of the trace context of the request that stored the message, as JSON.
+	traceContext sql.NullString
+}
+
+// Enqueue stores the given payload in the outbox using the given transaction, so the message is only published if
+// the transaction is committed. Messages are keyed by the aggregate ID, so the changes of the same aggregate are
+// consumed in order, and a nil payload is published as a tombstone. The request ID carried by the given context, if
+// any, is published along with the message, as well as its trace context, so the change can be followed up to the
+// legacy DB.
+func Enqueue(ctx context.Context, tx *sql.Tx, aggregateID string, payload interface{}) error {
+	var data []byte
+	if payload != nil {
+		var err error
+		data, err = json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("an error occured while marshalling the outbox message: %w", err)
+		}
+	}
+	requestID := logging.RequestID(ctx)
+	traceContext, err := marshalTraceContext(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, insertMessageSQL, aggregateID, data, sql.NullString{String: requestID, Valid: requestID != ""}, traceContext, time.Now()); err != nil {
+		return fmt.Errorf("an error occured while inserting the outbox message: %w", err)
+	}
+	return nil
+}
+
+// marshalTraceContext returns the trace context of the given context as JSON, if any.
+func marshalTraceContext(ctx context.Context) (sql.NullString, error) {
+	headers := make(map[string]string)
+	tracing.Inject(ctx, headers)
+	if len(headers) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("an error occured while marshalling the trace context: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// Relay publishes the pending outbox messages to Kafka.
+type Relay struct {
+	dbConn       database.Connection
+	writer       kafka.Writer
+	pollInterval time.Duration
+	batchSize    int
+	async        bool
+	logger       *slog.Logger
+	// mu guards the ID of the last message handed to an asynchronous writer, after which the pending messages are
+	// searched, since the messages written but not acknowledged yet are still pending.
+	mu     sync.Mutex
+	lastID int64
+}
+
+// NewRelay creates a relay that publishes through the given writer. An asynchronous relay only marks the messages as
+// sent once the writer reports them as acknowledged to Complete.
+func NewRelay(dbConn database.Connection, writer kafka.Writer, async bool, logger *slog.Logger) *Relay {
+	return &Relay{
+		dbConn:       dbConn,
+		writer:       writer,
+		pollInterval: defaultPollInterval,
+		batchSize:    defaultBatchSize,
+		async:        async,
+		logger:       logger,
+	}
+}
+
+// Run polls the outbox until the given context is done. Messages are published in the order they were stored and
+// only marked as sent after Kafka acknowledged them, so they are delivered at least once.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			sent, err := r.relay(ctx)
+			if err != nil {
+				r.logger.Error("could not relay the outbox messages", "error", err)
+				break
+			}
+			if sent < r.batchSize {
+				break
+			}
+		}
+	}
+}
+
+// relay publishes a single batch of pending messages. The rows are locked until the batch is marked as sent, so
+// concurrent relays never publish the same messages nor reorder them.
+func (r *Relay) relay(ctx context.Context) (sent int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultRelayTimeout)
+	defer cancel()
+	err = r.dbConn.Transaction(ctx, func(tx *sql.Tx) error {
+		msgs, err := r.pending(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		kafkaMsgs := make([]kafka.Message, 0, len(msgs))
+		for _, msg := range msgs {
+			headers := map[string]string{HeaderOutboxID: strconv.FormatInt(msg.id, 10)}
+			if msg.requestID.Valid {
+				headers[kafka.HeaderRequestID] = msg.requestID.String
+			}
+			if msg.traceContext.Valid {
+				// the writer continues the trace of the request from these headers
+				if err := json.Unmarshal([]byte(msg.traceContext.String), &headers); err != nil {
+					r.logger.Warn("the trace context of the outbox message is invalid", "outbox_id", msg.id, "error", err)
+				}
+			}
+			kafkaMsgs = append(kafkaMsgs, kafka.Message{
+				Key:     []byte(msg.aggregateID),
+				Value:   msg.payload,
+				Headers: headers,
+			})
+		}
+		if r.async {
+			// moved forward before writing, so a failure completed meanwhile is able to move it back
+			r.mu.Lock()
+			r.lastID = msgs[len(msgs)-1].id
+			r.mu.Unlock()
+		}
+		if err = r.writer.WriteMessages(ctx, kafkaMsgs...); err != nil {
+			if r.async {
+				r.rewind([]int64{msgs[0].id})
+			}
+			return fmt.Errorf("an error occured while publishing the outbox messages: %w", err)
+		}
+		sent = len(msgs)
+		if r.async {
+			return nil
+		}
+		now := time.Now()
+		for _, msg := range msgs {
+			if _, err = tx.ExecContext(ctx, markMessageAsSentSQL, now, msg.id); err != nil {
+				return fmt.Errorf("an error occured while marking the outbox message %d as sent: %w", msg.id, err)
+			}
+		}
+		return nil
+	})
+	return sent, err
+}
+
+func (r *Relay) pending(ctx context.Context, tx *sql.Tx) ([]message, error) {
+	r.mu.Lock()
+	lastID := r.lastID
+	r.mu.Unlock()
+	rows, err := tx.QueryContext(ctx, getPendingMessagesSQL, lastID, r.batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while searching the outbox: %w", err)
+	}
+	defer rows.Close()
+	var msgs []message
+	for rows.Next() {
+		msg := message{}
+		if err = rows.Scan(&msg.id, &msg.aggregateID, &msg.payload, &msg.requestID, &msg.traceContext); err != nil {
+			return nil, fmt.Errorf("an error occured while reading the outbox: %w", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+// Complete marks the given asynchronously written messages as sent once acknowledged. When they failed, the relay
+// goes back to the first of them, so they are published again.
+func (r *Relay) Complete(msgs []kafka.Message, err error) {
+	ids := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		id, parseErr := strconv.ParseInt(msg.Headers[HeaderOutboxID], 10, 64)
+		if parseErr != nil {
+			r.logger.Error("the message has no outbox ID", "aggregate_id", string(msg.Key))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if err != nil {
+		r.logger.Error("could not publish the outbox messages", "error", err, "count", len(ids))
+		r.rewind(ids)
+		return
+	}
+	if markErr := r.markAsSent(ids); markErr != nil {
+		r.logger.Error("could not mark the outbox messages as sent", "error", markErr, "count", len(ids))
+		r.rewind(ids)
+	}
+}
+
+// rewind makes the relay search the pending messages again from the lowest of the given IDs.
+func (r *Relay) rewind(ids []int64) {
+	lowest := ids[0]
+	for _, id := range ids {
+		if id < lowest {
+			lowest = id
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if lowest-1 < r.lastID {
+		r.lastID = lowest - 1
+	}
+}
+
+func (r *Relay) markAsSent(ids []int64) error {
+	ctx, cancel := r.dbConn.CreateContext(context.Background())
+	defer cancel()
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, time.Now())
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	query := fmt.Sprintf(markMessagesAsSentSQL, strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", "))
+	if _, err := r.dbConn.DB().ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("an error occured while marking %d outbox messages as sent: %w", len(ids), err)
+	}
+	return nil
+}
@@ -17,8 +17,12 @@ curl -i -X PUT http://localhost:8083/connectors/film_source/config -H "Content-T
            "timestamp.column.name": "last_update",
            "topic.prefix":"p_film",
            "validate.non.null":"false",
-           "transforms": "Cast",
+           "transforms": "Cast,createKey,extractKey",
            "transforms.Cast.type": "org.apache.kafka.connect.transforms.Cast$Value",
            "transforms.Cast.spec": "release_year:string",
-           "query":"SELECT film_id, title, last_update, language_id, release_year, uuid FROM film"
+           "transforms.createKey.type": "org.apache.kafka.connect.transforms.ValueToKey",
+           "transforms.createKey.fields": "film_id",
+           "transforms.extractKey.type": "org.apache.kafka.connect.transforms.ExtractField$Key",
+           "transforms.extractKey.field": "film_id",
+           "query":"SELECT film_id, title, last_update, language_id, release_year, uuid, deleted_at, sync_origin, sync_hash FROM film"
        }';